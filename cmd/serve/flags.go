@@ -0,0 +1,18 @@
+package serve
+
+import "strings"
+
+// stringSliceFlag is a flag which may be set several times, accumulating every value
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
@@ -0,0 +1,206 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+	"github.com/baalimago/wd-41/internal/proxy"
+	"github.com/baalimago/wd-41/internal/wsinject"
+	"golang.org/x/net/websocket"
+)
+
+type proxyCommand struct {
+	binPath    string
+	target     *url.URL
+	watchPath  string
+	port       *int
+	wsPath     *string
+	flagset    *flag.FlagSet
+	fileserver Fileserver
+
+	targetURL *string
+	watch     *string
+
+	tlsCertPath *string
+	tlsKeyPath  *string
+
+	debounce  *time.Duration
+	ignore    stringSliceFlag
+	gitignore *bool
+
+	watcher      *string
+	pollInterval *time.Duration
+	pollHash     *bool
+
+	publicURL      *string
+	forwardConsole *bool
+
+	build stringSliceFlag
+}
+
+// ProxyCommand forwards every request to a backend, injecting the delta-streamer
+// script into its html responses and reloading the pages on changes of the watched
+// directory
+func ProxyCommand() *proxyCommand {
+	r, _ := os.Executable()
+	return &proxyCommand{
+		binPath: r,
+	}
+}
+
+func (c *proxyCommand) Setup(_ context.Context) error {
+	if *c.targetURL == "" {
+		return errors.New("missing target, set it using -target <url>")
+	}
+	target, err := proxy.ParseTarget(*c.targetURL)
+	if err != nil {
+		return err
+	}
+	c.target = target
+	if *c.publicURL != "" {
+		u, err := url.Parse(*c.publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid public url: '%v', expected an absolute http or https url", *c.publicURL)
+		}
+	}
+	c.watchPath = path.Clean(*c.watch)
+
+	if c.fileserver == nil {
+		opts := []wsinject.Option{
+			wsinject.WithDebounce(*c.debounce),
+			wsinject.WithIgnore(c.ignore...),
+			wsinject.WithGitignore(*c.gitignore),
+			// The watched directory is only watched, the responses are injected as they're proxied
+			wsinject.WithMode(wsinject.ModeMiddleware),
+			wsinject.WithPublicURL(*c.publicURL),
+			wsinject.WithConsoleForwarding(*c.forwardConsole),
+			wsinject.WithBuildCommands(c.build...),
+		}
+		switch *c.watcher {
+		case "fsnotify":
+		case "poll":
+			opts = append(opts, wsinject.WithPollWatcher(*c.pollInterval, *c.pollHash))
+		default:
+			return fmt.Errorf("unknown watcher: '%v', expected 'fsnotify' or 'poll'", *c.watcher)
+		}
+		// The backend decides which files its pages are rendered from, so every change
+		// reloads every page
+		c.fileserver = wsinject.NewFileServer(*c.wsPath, true, opts...)
+	}
+	_, err = c.fileserver.Setup(c.watchPath)
+	if err != nil {
+		return fmt.Errorf("failed to setup watcher of: '%v', err: %w", c.watchPath, err)
+	}
+	return nil
+}
+
+func (c *proxyCommand) Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	var h http.Handler = proxy.New(c.target)
+	h = c.fileserver.InjectHandler(h)
+	h = SlogHandler(h)
+	mux.Handle("/", h)
+
+	mux.HandleFunc(wsinject.ClientScriptPath, c.fileserver.ClientScriptHandler)
+
+	ancli.Okf("setting up websocket host on path: '%v'", *c.wsPath)
+	mux.Handle(*c.wsPath, websocket.Handler(c.fileserver.WsHandler))
+
+	s := http.Server{
+		Addr:    fmt.Sprintf(":%v", *c.port),
+		Handler: mux,
+	}
+	serverErrChan := make(chan error, 1)
+	fsErrChan := make(chan error, 1)
+	go func() {
+		serveTLS := *c.tlsCertPath != "" && *c.tlsKeyPath != ""
+		protocol := "http"
+		if serveTLS {
+			protocol = "https"
+		}
+
+		ancli.Okf("Proxy started successfully:")
+		ancli.Okf("- URL: %s://localhost:%d", protocol, *c.port)
+		if *c.publicURL != "" {
+			ancli.Okf("- Public URL: %s", *c.publicURL)
+		}
+		ancli.Okf("- Proxying to: '%v'", c.target)
+		ancli.Okf("- Watching directory: '%v'", c.watchPath)
+		if *c.forwardConsole {
+			ancli.Okf("- Forwarding browser console output")
+		}
+		for _, b := range c.build {
+			ancli.Okf("- Building: '%v'", b)
+		}
+
+		var err error
+		if serveTLS {
+			err = s.ListenAndServeTLS(*c.tlsCertPath, *c.tlsKeyPath)
+		} else {
+			err = s.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serverErrChan <- err
+		}
+	}()
+	go func() {
+		ancli.Okf("starting %v file detector", *c.watcher)
+		err := c.fileserver.Start(ctx)
+		if err != nil {
+			fsErrChan <- err
+		}
+	}()
+	var retErr error
+	select {
+	case <-ctx.Done():
+	case serveErr := <-serverErrChan:
+		retErr = serveErr
+	case fsErr := <-fsErrChan:
+		retErr = fsErr
+	}
+	ancli.PrintNotice("initiating proxy graceful shutdown")
+	s.Shutdown(ctx)
+	err := c.fileserver.Close()
+	if err != nil {
+		ancli.Errf("failed to close fileserver: %v", err)
+	}
+	ancli.Okf("shutdown complete")
+	return retErr
+}
+
+func (c *proxyCommand) Help() string {
+	return "Proxy a backend, live reloading its pages on changes of the watched directory: wd-41 proxy -target http://127.0.0.1:3000 -watch ./templates"
+}
+
+func (c *proxyCommand) Describe() string {
+	return fmt.Sprintf("a live reloading reverse proxy. Usage: '%v proxy -target <url> -watch <path>'. If -watch is left unset, current pwd will be watched.", c.binPath)
+}
+
+func (c *proxyCommand) Flagset() *flag.FlagSet {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	c.port = fs.Int("port", 8080, "port to serve the proxy on")
+	c.targetURL = fs.String("target", "", "url of the backend to forward every request to, such as 'http://127.0.0.1:3000'")
+	c.watch = fs.String("watch", ".", "directory to watch, every connected page reloads when a file within it changes")
+	c.wsPath = fs.String("wsPort", "/delta-streamer-ws", "the path which the delta streamer websocket should be hosted on")
+	c.debounce = fs.Duration("debounce", 100*time.Millisecond, "time to wait for file changes to settle before reloading, changes within the window are batched into one reload")
+	fs.Var(&c.ignore, "ignore", "glob pattern, in .gitignore syntax, of paths to not watch. May be set multiple times. Patterns may also be set in a .wd41ignore file at the root of the watched directory")
+	c.gitignore = fs.Bool("gitignore", true, "set to false to not ignore the paths ignored by the .gitignore at the root of the watched directory")
+	c.publicURL = fs.String("publicURL", "", "set to the url which browsers reach wd-41 on, if it's served through another reverse proxy. By default, browsers connect back to the host which served the page")
+	fs.Var(&c.build, "build", "build command to run before reloading, when a file matching its glob changes, formatted as '<glob> -> <command>'. May be set multiple times")
+	c.forwardConsole = fs.Bool("forwardConsole", false, "set to true to print the console output, uncaught errors and unhandled promise rejections of the connected browsers")
+	c.watcher = fs.String("watcher", "fsnotify", "the file change detector to use, 'fsnotify' or 'poll'")
+	c.pollInterval = fs.Duration("pollInterval", 500*time.Millisecond, "interval to scan for file changes with, when using the poll watcher")
+	c.pollHash = fs.Bool("pollHash", false, "set to true to detect changes by file content instead of modification time and size, when using the poll watcher")
+	c.tlsCertPath = fs.String("tlsCertPath", "", "set to a path to a cert, requires tlsKeyPath to be set")
+	c.tlsKeyPath = fs.String("tlsKeyPath", "", "set to a path to a key, requires tlsCertPath to be set")
+	c.flagset = fs
+	return fs
+}
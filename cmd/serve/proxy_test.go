@@ -0,0 +1,162 @@
+package serve
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+	"github.com/baalimago/wd-41/internal/wsinject"
+	"golang.org/x/net/websocket"
+)
+
+func Test_proxyCommand_Setup(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		args []string
+		want string
+	}{
+		{desc: "it should require a target", args: []string{}, want: "missing target"},
+		{desc: "it should require an absolute target", args: []string{"-target", "localhost:3000"}, want: "invalid target"},
+		{desc: "it should reject unknown watchers", args: []string{"-target", "http://localhost:3000", "-watcher", "nope"}, want: "unknown watcher"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := ProxyCommand()
+			err := c.Flagset().Parse(append(tc.args, "-watch", t.TempDir()))
+			if err != nil {
+				t.Fatalf("failed to parse flagset: %v", err)
+			}
+			err = c.Setup(context.Background())
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			testboil.AssertStringContains(t, err.Error(), tc.want)
+		})
+	}
+}
+
+func Test_proxyCommand_Run(t *testing.T) {
+	backend := http.NewServeMux()
+	backend.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<html><head></head><body>backend: %v</body></html>", r.URL.Path)
+	})
+	backend.HandleFunc("/gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("<html><head></head><body>compressed</body></html>"))
+		gz.Close()
+	})
+	backend.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		for _, chunk := range []string{"<html><he", "ad></head><bo", "dy>chunked</body></html>"} {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	})
+	backend.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	})
+	backend.Handle("/echo", websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+
+	watchDir := t.TempDir()
+	port := 18091
+	c := ProxyCommand()
+	err := c.Flagset().Parse([]string{"-target", server.URL, "-watch", watchDir, "-port", fmt.Sprint(port), "-debounce", "0s"})
+	if err != nil {
+		t.Fatalf("failed to parse flagset: %v", err)
+	}
+	err = c.Setup(context.Background())
+	if err != nil {
+		t.Fatalf("failed to setup: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go c.Run(ctx)
+	base := fmt.Sprintf("http://localhost:%v", port)
+
+	for _, tc := range []struct {
+		urlPath string
+		want    string
+	}{
+		{urlPath: "/some/page?q=1", want: "backend: /some/page"},
+		{urlPath: "/gzip", want: "compressed"},
+		{urlPath: "/chunked", want: "chunked"},
+	} {
+		t.Run("it should inject the html of: "+tc.urlPath, func(t *testing.T) {
+			resp, err := getWhenUp(base + tc.urlPath)
+			if err != nil {
+				t.Fatalf("failed to get: %v", err)
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			testboil.AssertStringContains(t, string(b), tc.want)
+			testboil.AssertStringContains(t, string(b), wsinject.ClientScriptPath)
+		})
+	}
+
+	t.Run("it should leave other responses as they are", func(t *testing.T) {
+		resp, err := getWhenUp(base + "/api")
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		testboil.FailTestIfDiff(t, string(b), `{"ok":true}`)
+	})
+
+	t.Run("it should forward websockets", func(t *testing.T) {
+		ws, err := websocket.Dial(fmt.Sprintf("ws://localhost:%v/echo", port), "", base)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer ws.Close()
+		websocket.Message.Send(ws, "ping")
+		var got string
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		err = websocket.Message.Receive(ws, &got)
+		if err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+		testboil.FailTestIfDiff(t, got, "ping")
+	})
+
+	t.Run("it should send reloads on changes of watched files", func(t *testing.T) {
+		ws, err := websocket.Dial(fmt.Sprintf("ws://localhost:%v/delta-streamer-ws", port), "", base)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer ws.Close()
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		websocket.JSON.Send(ws, map[string]any{"v": 1, "type": "hello", "versions": []int{1}})
+		var welcome map[string]any
+		err = websocket.JSON.Receive(ws, &welcome)
+		if err != nil {
+			t.Fatalf("failed to receive welcome: %v", err)
+		}
+		os.WriteFile(path.Join(watchDir, "page.tmpl"), []byte("changed"), 0o644)
+		var got json.RawMessage
+		err = websocket.JSON.Receive(ws, &got)
+		if err != nil {
+			t.Fatalf("failed to receive change: %v", err)
+		}
+		if !strings.Contains(string(got), `"type":"change"`) || !strings.Contains(string(got), "/page.tmpl") {
+			t.Fatalf("expected change of page.tmpl, got: %s", got)
+		}
+	})
+}
@@ -5,19 +5,35 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+	"github.com/baalimago/wd-41/internal/proxy"
 	"github.com/baalimago/wd-41/internal/wsinject"
 	"golang.org/x/net/websocket"
 )
 
+// proxyPrefixReserved are the characters which ServeMux patterns interpret, as wildcards
+// or as the separator of the method, and may therefore not be in proxy prefixes
+const proxyPrefixReserved = "{} \t"
+
 type Fileserver interface {
 	Setup(pathToMaster string) (string, error)
 	Start(ctx context.Context) error
 	WsHandler(ws *websocket.Conn)
+	FS() fs.FS
+	InjectHandler(next http.Handler) http.Handler
+	RenderHandler(next http.Handler) http.Handler
+	SPAHandler(next http.Handler) http.Handler
+	ErrorPageHandler(next http.Handler) http.Handler
+	ClientScriptHandler(w http.ResponseWriter, r *http.Request)
+	Close() error
 }
 
 type command struct {
@@ -34,6 +50,35 @@ type command struct {
 	cacheControl *string
 	tlsCertPath  *string
 	tlsKeyPath   *string
+
+	debounce  *time.Duration
+	ignore    stringSliceFlag
+	gitignore *bool
+
+	watcher      *string
+	pollInterval *time.Duration
+	pollHash     *bool
+
+	mode      *string
+	mirrorDir *string
+
+	inject   stringSliceFlag
+	noInject stringSliceFlag
+
+	publicURL      *string
+	forwardConsole *bool
+
+	build stringSliceFlag
+
+	markdownLayout *string
+
+	spa         *bool
+	spaFallback *string
+	spaExclude  stringSliceFlag
+
+	proxy             stringSliceFlag
+	proxyPreserveHost *bool
+	proxyRules        []proxy.Rule
 }
 
 func Command() *command {
@@ -57,8 +102,39 @@ func (c *command) Setup(_ context.Context) error {
 	c.masterPath = path.Clean(relPath)
 
 	if c.masterPath != "" {
-		expectTLS := *c.tlsCertPath != "" && *c.tlsKeyPath != ""
-		c.fileserver = wsinject.NewFileServer(*c.port, *c.wsPath, *c.forceReload, expectTLS)
+		if *c.publicURL != "" {
+			u, err := url.Parse(*c.publicURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid public url: '%v', expected an absolute http or https url", *c.publicURL)
+			}
+		}
+		err := c.setupProxyRules()
+		if err != nil {
+			return err
+		}
+		opts := []wsinject.Option{
+			wsinject.WithDebounce(*c.debounce),
+			wsinject.WithIgnore(c.ignore...),
+			wsinject.WithGitignore(*c.gitignore),
+			wsinject.WithMode(wsinject.Mode(*c.mode)),
+			wsinject.WithMirrorDir(*c.mirrorDir),
+			wsinject.WithInjectRules(c.inject, c.noInject),
+			wsinject.WithPublicURL(*c.publicURL),
+			wsinject.WithConsoleForwarding(*c.forwardConsole),
+			wsinject.WithBuildCommands(c.build...),
+			wsinject.WithMarkdownLayout(*c.markdownLayout),
+		}
+		if *c.spa {
+			opts = append(opts, wsinject.WithSPAFallback(*c.spaFallback, c.spaExclude...))
+		}
+		switch *c.watcher {
+		case "fsnotify":
+		case "poll":
+			opts = append(opts, wsinject.WithPollWatcher(*c.pollInterval, *c.pollHash))
+		default:
+			return fmt.Errorf("unknown watcher: '%v', expected 'fsnotify' or 'poll'", *c.watcher)
+		}
+		c.fileserver = wsinject.NewFileServer(*c.wsPath, *c.forceReload, opts...)
 		mirrorPath, err := c.fileserver.Setup(c.masterPath)
 		if err != nil {
 			return fmt.Errorf("failed to setup websocket injected mirror filesystem: %v", err)
@@ -69,13 +145,55 @@ func (c *command) Setup(_ context.Context) error {
 	return nil
 }
 
+// setupProxyRules parses the proxy rules, which may neither overlap each other nor the
+// reserved routes of wd-41
+func (c *command) setupProxyRules() error {
+	c.proxyRules = nil
+	seen := make(map[string]bool)
+	for _, spec := range c.proxy {
+		rule, err := proxy.ParseRule(spec)
+		if err != nil {
+			return err
+		}
+		if seen[rule.Prefix] ||
+			rule.Prefix == path.Clean(*c.wsPath) ||
+			rule.Prefix == wsinject.ClientScriptPath ||
+			strings.HasPrefix(wsinject.ClientScriptPath, rule.Prefix+"/") {
+			return fmt.Errorf("invalid proxy rule: '%v', the prefix is already in use", spec)
+		}
+		if strings.ContainsAny(rule.Prefix, proxyPrefixReserved) {
+			// The prefix is registered as a ServeMux pattern, which would panic on these
+			return fmt.Errorf("invalid proxy rule: '%v', the prefix may not contain any of: '%v'", spec, proxyPrefixReserved)
+		}
+		seen[rule.Prefix] = true
+		rule.PreserveHost = *c.proxyPreserveHost
+		c.proxyRules = append(c.proxyRules, rule)
+	}
+	return nil
+}
+
 func (c *command) Run(ctx context.Context) error {
 	mux := http.NewServeMux()
-	fsh := http.FileServer(http.Dir(c.mirrorPath))
+	fsh := http.FileServer(http.FS(c.fileserver.FS()))
+	if wsinject.Mode(*c.mode) == wsinject.ModeMiddleware {
+		fsh = c.fileserver.InjectHandler(fsh)
+	}
+	// Rendered pages are injected as they're rendered
+	fsh = c.fileserver.RenderHandler(fsh)
+	fsh = c.fileserver.SPAHandler(fsh)
+	fsh = c.fileserver.ErrorPageHandler(fsh)
 	fsh = SlogHandler(fsh)
 	fsh = CacheHandler(fsh, *c.cacheControl)
 	fsh = CrossOriginIsolationHandler(fsh)
 	mux.Handle("/", fsh)
+	for _, rule := range c.proxyRules {
+		h := rule.Handler()
+		// Both the prefix itself and everything below it
+		mux.Handle(rule.Prefix, h)
+		mux.Handle(rule.Prefix+"/", h)
+	}
+
+	mux.HandleFunc(wsinject.ClientScriptPath, c.fileserver.ClientScriptHandler)
 
 	ancli.Okf("setting up websocket host on path: '%v'", *c.wsPath)
 	mux.Handle(*c.wsPath, websocket.Handler(c.fileserver.WsHandler))
@@ -99,8 +217,30 @@ func (c *command) Run(ctx context.Context) error {
 
 		ancli.Okf("Server started successfully:")
 		ancli.Okf("- URL: %s", baseURL)
+		if *c.publicURL != "" {
+			ancli.Okf("- Public URL: %s", *c.publicURL)
+		}
 		ancli.Okf("- Serving directory: '%v'", c.masterPath)
-		ancli.Okf("- Mirror directory: '%v'", c.mirrorPath)
+		if *c.forwardConsole {
+			ancli.Okf("- Forwarding browser console output")
+		}
+		if *c.spa {
+			ancli.Okf("- Single page app fallback: '%v'", *c.spaFallback)
+		}
+		for _, b := range c.build {
+			ancli.Okf("- Building: '%v'", b)
+		}
+		for _, rule := range c.proxyRules {
+			ancli.Okf("- Proxying: '%v' -> '%v'", rule.Prefix, rule.Target)
+		}
+		switch wsinject.Mode(*c.mode) {
+		case wsinject.ModeOverlay:
+			ancli.Okf("- Serving through in-memory overlay")
+		case wsinject.ModeMiddleware:
+			ancli.Okf("- Injecting html responses as they're served")
+		default:
+			ancli.Okf("- Mirror directory: '%v'", c.mirrorPath)
+		}
 		if serveTLS {
 			ancli.Okf("- TLS enabled (cert: '%v', key: '%v')", *c.tlsCertPath, *c.tlsKeyPath)
 		} else {
@@ -118,7 +258,7 @@ func (c *command) Run(ctx context.Context) error {
 		}
 	}()
 	go func() {
-		ancli.Okf("starting fsnotify file detector")
+		ancli.Okf("starting %v file detector", *c.watcher)
 		err := c.fileserver.Start(ctx)
 		if err != nil {
 			fsErrChan <- err
@@ -136,6 +276,10 @@ func (c *command) Run(ctx context.Context) error {
 	}
 	ancli.PrintNotice("initiating webserver graceful shutdown")
 	s.Shutdown(ctx)
+	err := c.fileserver.Close()
+	if err != nil {
+		ancli.Errf("failed to close fileserver: %v", err)
+	}
 	ancli.Okf("shutdown complete")
 	return retErr
 }
@@ -153,6 +297,25 @@ func (c *command) Flagset() *flag.FlagSet {
 	c.port = fs.Int("port", 8080, "port to serve http server on")
 	c.wsPath = fs.String("wsPort", "/delta-streamer-ws", "the path which the delta streamer websocket should be hosted on")
 	c.forceReload = fs.Bool("forceReload", false, "set to true if you wish to reload all attached browser pages on any file change")
+	c.debounce = fs.Duration("debounce", 100*time.Millisecond, "time to wait for file changes to settle before reloading, changes within the window are batched into one reload")
+	fs.Var(&c.ignore, "ignore", "glob pattern, in .gitignore syntax, of paths to neither mirror nor watch. May be set multiple times. Patterns may also be set in a .wd41ignore file at the root of the served directory")
+	c.gitignore = fs.Bool("gitignore", true, "set to false to not ignore the paths ignored by the .gitignore at the root of the served directory")
+	c.mode = fs.String("mode", string(wsinject.ModeMirror), "how to serve the injected content. 'mirror' copies the directory to a temporary mirror, 'overlay' serves the directory directly, keeping only injected html pages in memory, 'middleware' serves the directory directly, injecting html responses as they're served")
+	fs.Var(&c.inject, "inject", "rule of files to inject the live reload script into, in addition to html files. '.ext' matches extension, 'type:<mime>' matches sniffed content type, anything else is a glob. May be set multiple times")
+	fs.Var(&c.noInject, "noInject", "rule of files to never inject the live reload script into, same syntax as -inject and takes precedence over it. May be set multiple times")
+	c.publicURL = fs.String("publicURL", "", "set to the url which browsers reach wd-41 on, if it's served through a reverse proxy. By default, browsers connect back to the host which served the page")
+	fs.Var(&c.build, "build", "build command to run before reloading, when a file matching its glob changes, formatted as '<glob> -> <command>', such as '*.scss -> sass style.scss style.css'. Failures are shown in the browser instead of reloading. May be set multiple times")
+	c.markdownLayout = fs.String("markdownLayout", "", "set to a html/template to render markdown pages into, executed with the .Title, .Content and .Path of the page. Keep it within the served directory to reload on changes of it")
+	c.spa = fs.Bool("spa", false, "set to true to serve a single page app, answering requests for paths without an extension which match no file with the -spaFallback page")
+	c.spaFallback = fs.String("spaFallback", "index.html", "the page, relative to the served directory, to answer single page app routes with, when -spa is set")
+	fs.Var(&c.spaExclude, "spaExclude", "path prefix, such as '/api', to never answer with the -spaFallback page. May be set multiple times")
+	fs.Var(&c.proxy, "proxy", "rule of requests to forward to a backend, formatted as '<prefix>=<target>', such as '/api=http://127.0.0.1:8000'. The request path is forwarded as it is, unless the target has a path, such as 'http://127.0.0.1:8000/', which then replaces the prefix. May be set multiple times")
+	c.proxyPreserveHost = fs.Bool("proxyPreserveHost", false, "set to true to forward the Host header of the requests to the -proxy backends, instead of the host of the backend")
+	c.forwardConsole = fs.Bool("forwardConsole", false, "set to true to print the console output, uncaught errors and unhandled promise rejections of the connected browsers, useful when testing on devices without devtools")
+	c.mirrorDir = fs.String("mirrorDir", "", "set to a directory to pin the mirror to, it's then reused across runs instead of creating a temporary mirror which is removed on shutdown")
+	c.watcher = fs.String("watcher", "fsnotify", "the file change detector to use, 'fsnotify' or 'poll'. Use 'poll' for filesystems where inotify doesn't work, such as docker bind mounts, NFS or sshfs")
+	c.pollInterval = fs.Duration("pollInterval", 500*time.Millisecond, "interval to scan for file changes with, when using the poll watcher")
+	c.pollHash = fs.Bool("pollHash", false, "set to true to detect changes by file content instead of modification time and size, when using the poll watcher")
 	c.cacheControl = fs.String("cacheControl", "no-cache", "set to configure the cache-control header")
 	c.tlsCertPath = fs.String("tlsCertPath", "", "set to a path to a cert, requires tlsKeyPath to be set")
 	c.tlsKeyPath = fs.String("tlsKeyPath", "", "set to a path to a key, requires tlsCertPath to be set")
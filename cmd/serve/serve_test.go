@@ -4,15 +4,37 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+	"github.com/baalimago/wd-41/internal/wsinject"
 	"golang.org/x/net/websocket"
 )
 
+// TestMain keeps the temporary mirrors of the tests, and the scan for stale ones, out
+// of the actual temporary directory
+func TestMain(m *testing.M) {
+	tmpDir, err := os.MkdirTemp("", "wd-41-serve-test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create temporary dir: %v\n", err)
+		os.Exit(1)
+	}
+	os.Setenv("TMPDIR", tmpDir)
+	code := m.Run()
+	os.RemoveAll(tmpDir)
+	os.Exit(code)
+}
+
 func Test_Setup(t *testing.T) {
 	tmpDir := t.TempDir()
 	t.Run("it should set masterPath to second argument", func(t *testing.T) {
@@ -69,6 +91,147 @@ func Test_Setup(t *testing.T) {
 			t.Fatalf("expected: %v, got: %v", want, got)
 		}
 	})
+
+	t.Run("it should set debounce arg", func(t *testing.T) {
+		want := 250 * time.Millisecond
+		c := command{}
+		givenArgs := []string{"-debounce", "250ms"}
+		err := c.Flagset().Parse(givenArgs)
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+
+		got := *c.debounce
+		if got != want {
+			t.Fatalf("expected: %v, got: %v", want, got)
+		}
+	})
+
+	t.Run("it should fail on unknown watcher", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-watcher", "telepathy"})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err == nil {
+			t.Fatal("expected error on unknown watcher")
+		}
+	})
+
+	t.Run("it should fail on unknown mode", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-mode", "telepathy"})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err == nil {
+			t.Fatal("expected error on unknown mode")
+		}
+	})
+
+	t.Run("it should not create a mirror in overlay mode", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-mode", "overlay", tmpDir})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+		if c.mirrorPath != "" {
+			t.Fatalf("expected no mirror path, got: '%v'", c.mirrorPath)
+		}
+	})
+
+	t.Run("it should fail on relative public url", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-publicURL", "dev.example.com"})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err == nil {
+			t.Fatal("expected error on relative public url")
+		}
+	})
+
+	t.Run("it should fail on overlapping proxy rules", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-proxy", "/api=http://127.0.0.1:8000", "-proxy", "/api/=http://127.0.0.1:9000", t.TempDir()})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		testboil.AssertStringContains(t, err.Error(), "already in use")
+	})
+
+	for _, given := range []string{wsinject.ClientScriptPath, "/__wd41", "/delta-streamer-ws", "/api/{id}", "/api/{rest...}", "/my api"} {
+		t.Run("it should fail on proxy rules with the prefix: "+given, func(t *testing.T) {
+			c := command{}
+			err := c.Flagset().Parse([]string{"-proxy", given + "=http://127.0.0.1:8000", t.TempDir()})
+			if err != nil {
+				t.Fatalf("failed to parse flagset: %v", err)
+			}
+			err = c.Setup(context.Background())
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			testboil.AssertStringContains(t, err.Error(), "invalid proxy rule")
+		})
+	}
+
+	t.Run("it should fail to poll without a positive interval", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-watcher", "poll", "-pollInterval", "0s", t.TempDir()})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err == nil {
+			t.Fatal("expected error on poll watcher without a positive interval")
+		}
+	})
+
+	t.Run("it should fail on build commands without a glob", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-build", "sass style.scss style.css", t.TempDir()})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err == nil {
+			t.Fatal("expected error on build command without a glob")
+		}
+	})
+
+	t.Run("it should accumulate repeated ignore args", func(t *testing.T) {
+		want := []string{"*.log", "tmp/"}
+		c := command{}
+		givenArgs := []string{"-ignore", "*.log", "-ignore", "tmp/"}
+		err := c.Flagset().Parse(givenArgs)
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+
+		got := []string(c.ignore)
+		if !slices.Equal(got, want) {
+			t.Fatalf("expected: %v, got: %v", want, got)
+		}
+	})
 }
 
 type mockFileServer struct{}
@@ -84,6 +247,32 @@ func (m *mockFileServer) Start(ctx context.Context) error {
 
 func (m *mockFileServer) WsHandler(ws *websocket.Conn) {}
 
+func (m *mockFileServer) FS() fs.FS {
+	return fstest.MapFS{}
+}
+
+func (m *mockFileServer) InjectHandler(next http.Handler) http.Handler {
+	return next
+}
+
+func (m *mockFileServer) RenderHandler(next http.Handler) http.Handler {
+	return next
+}
+
+func (m *mockFileServer) SPAHandler(next http.Handler) http.Handler {
+	return next
+}
+
+func (m *mockFileServer) ErrorPageHandler(next http.Handler) http.Handler {
+	return next
+}
+
+func (m *mockFileServer) ClientScriptHandler(w http.ResponseWriter, r *http.Request) {}
+
+func (m *mockFileServer) Close() error {
+	return nil
+}
+
 func TestRun(t *testing.T) {
 	setup := func() command {
 		cmd := command{}
@@ -114,6 +303,7 @@ func TestRun(t *testing.T) {
 		t.Cleanup(ctxCancel)
 
 		<-ready
+		time.Sleep(time.Millisecond)
 		// Test if the HTTP server is working
 		resp, err := http.Get("http://localhost:8081/")
 		if err != nil {
@@ -238,4 +428,131 @@ EKTcWGekdmdDPsHloRNtsiCa697B2O9IFA==
 			t.Fatalf("expected status code: %v", resp.StatusCode)
 		}
 	})
+
+	t.Run("it should inject html responses in middleware mode", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(path.Join(dir, "index.html"), []byte("<html><head></head><body></body></html>"), 0o644)
+		c := command{}
+		err := c.Flagset().Parse([]string{"-mode", "middleware", "-port", "13338", dir})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go c.Run(ctx)
+		resp, err := getWhenUp("http://localhost:13338/index.html")
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		testboil.AssertStringContains(t, string(b), wsinject.ClientScriptPath)
+
+		resp, err = http.Get("http://localhost:13338" + wsinject.ClientScriptPath)
+		if err != nil {
+			t.Fatalf("failed to get client script: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ = io.ReadAll(resp.Body)
+		testboil.AssertStringContains(t, string(b), "wd-41")
+	})
+
+	t.Run("it should forward requests matching the proxy rules", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				websocket.Handler(func(ws *websocket.Conn) { io.Copy(ws, ws) }).ServeHTTP(w, r)
+				return
+			}
+			io.WriteString(w, "backend: "+r.URL.Path)
+		}))
+		t.Cleanup(backend.Close)
+		dir := t.TempDir()
+		os.WriteFile(path.Join(dir, "index.html"), []byte("<html><head></head><body>static</body></html>"), 0o644)
+		c := command{}
+		err := c.Flagset().Parse([]string{"-port", "13340", "-proxy", "/api=" + backend.URL, "-proxy", "/v2=" + backend.URL + "/", dir})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go c.Run(ctx)
+
+		for urlPath, want := range map[string]string{
+			"/":          "static",
+			"/api":       "backend: /api",
+			"/api/users": "backend: /api/users",
+			"/v2/users":  "backend: /users",
+		} {
+			resp, err := getWhenUp("http://localhost:13340" + urlPath)
+			if err != nil {
+				t.Fatalf("failed to get: %v", err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			testboil.AssertStringContains(t, string(b), want)
+		}
+
+		ws, err := websocket.Dial("ws://localhost:13340/api/ws", "", "http://localhost/")
+		if err != nil {
+			t.Fatalf("failed to dial through proxy rule: %v", err)
+		}
+		defer ws.Close()
+		websocket.Message.Send(ws, "ping")
+		var got string
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		err = websocket.Message.Receive(ws, &got)
+		if err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+		testboil.FailTestIfDiff(t, got, "ping")
+	})
+
+	t.Run("it should remove the mirror on graceful shutdown", func(t *testing.T) {
+		c := command{}
+		err := c.Flagset().Parse([]string{"-port", "13339", t.TempDir()})
+		if err != nil {
+			t.Fatalf("failed to parse flagset: %v", err)
+		}
+		err = c.Setup(context.Background())
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			c.Run(ctx)
+			close(done)
+		}()
+		time.Sleep(time.Millisecond)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected run to return after context cancel")
+		}
+		_, err = os.Stat(c.mirrorPath)
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected mirror: '%v' to be removed, got err: %v", c.mirrorPath, err)
+		}
+	})
+}
+
+// getWhenUp retries the request until the server started by Run is listening
+func getWhenUp(url string) (*http.Response, error) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err == nil || time.Now().After(deadline) {
+			return resp, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
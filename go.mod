@@ -6,6 +6,7 @@ require github.com/baalimago/go_away_boilerplate v1.33.0
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0
+	github.com/yuin/goldmark v1.8.6
 	golang.org/x/net v0.28.0
 	golang.org/x/sys v0.23.0 // indirect
 )
@@ -0,0 +1,107 @@
+// Package proxy forwards http requests, including websocket upgrades, to a backend
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+)
+
+// ruleSeparator separates the path prefix from the target of a rule
+const ruleSeparator = "="
+
+// Rule forwards the requests within Prefix to Target
+type Rule struct {
+	// Prefix of the request paths to forward, such as '/api'
+	Prefix string
+	// Target to forward to. If it has a path, such as 'http://127.0.0.1:8000/v2', the
+	// prefix is replaced by it, otherwise the request path is forwarded as it is.
+	Target *url.URL
+	// PreserveHost forwards the Host header of the request, instead of the host of Target
+	PreserveHost bool
+}
+
+// ParseTarget parses the url of a backend, which must be an absolute http or https url
+func ParseTarget(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid target: '%v', expected an absolute http or https url", target)
+	}
+	return u, nil
+}
+
+// ParseRule parses a rule formatted as '<prefix>=<target>', such as
+// '/api=http://127.0.0.1:8000'
+func ParseRule(spec string) (Rule, error) {
+	prefix, target, found := strings.Cut(spec, ruleSeparator)
+	if !found || !strings.HasPrefix(prefix, "/") {
+		return Rule{}, fmt.Errorf("invalid proxy rule: '%v', expected '<prefix>%v<target>', such as '/api%vhttp://127.0.0.1:8000'", spec, ruleSeparator, ruleSeparator)
+	}
+	prefix = path.Clean(prefix)
+	if prefix == "/" {
+		return Rule{}, fmt.Errorf("invalid proxy rule: '%v', the prefix may not be the root, use 'wd-41 proxy' to proxy everything", spec)
+	}
+	u, err := ParseTarget(target)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid proxy rule: '%v': %w", spec, err)
+	}
+	return Rule{Prefix: prefix, Target: u}, nil
+}
+
+// New returns a reverse proxy which forwards every request to target, joining the
+// request path onto the path of target. Websocket upgrades are forwarded as well.
+func New(target *url.URL) *httputil.ReverseProxy {
+	return newReverseProxy(target, func(pr *httputil.ProxyRequest) {
+		pr.SetURL(target)
+		pr.SetXForwarded()
+	})
+}
+
+// Handler returns a reverse proxy which forwards the requests within the prefix of
+// the rule, logging each of them. Websocket upgrades are forwarded as well.
+func (r Rule) Handler() http.Handler {
+	return newReverseProxy(r.Target, r.rewrite)
+}
+
+// rewrite the request to target, replacing the prefix if the target has a path
+func (r Rule) rewrite(pr *httputil.ProxyRequest) {
+	var rest string
+	if r.Target.Path != "" {
+		rest = strings.TrimPrefix(pr.In.URL.EscapedPath(), r.Prefix)
+		pr.Out.URL.RawPath = rest
+		pr.Out.URL.Path, _ = url.PathUnescape(rest)
+	}
+	pr.SetURL(r.Target)
+	if r.Target.Path != "" && rest == "" {
+		// The prefix itself is forwarded to the path of the target, without a trailing slash
+		pr.Out.URL.Path = r.Target.Path
+		pr.Out.URL.RawPath = r.Target.RawPath
+	}
+	pr.SetXForwarded()
+	if r.PreserveHost {
+		pr.Out.Host = pr.In.Host
+	}
+	ancli.Okf("%s - %s -> %s", pr.In.Method, pr.In.URL.Path, pr.Out.URL)
+}
+
+func newReverseProxy(target *url.URL, rewrite func(*httputil.ProxyRequest)) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: rewrite,
+		// Stream responses as they arrive, such as server-sent events and chunked pages
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, r.Context().Err()) {
+				// The client went away, there's no one to respond to
+				return
+			}
+			ancli.Errf("failed to proxy: '%v %v' to: '%v', err: %v", r.Method, r.URL.Path, target, err)
+			http.Error(w, fmt.Sprintf("wd-41 failed to reach: '%v', err: %v", target, err), http.StatusBadGateway)
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func TestParseTarget(t *testing.T) {
+	for _, tc := range []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "http://127.0.0.1:3000", wantErr: false},
+		{target: "https://example.com/app", wantErr: false},
+		{target: "127.0.0.1:3000", wantErr: true},
+		{target: "ftp://example.com", wantErr: true},
+		{target: "http://", wantErr: true},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			_, err := ParseTarget(tc.target)
+			testboil.FailTestIfDiff(t, err != nil, tc.wantErr)
+		})
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, tc := range []struct {
+		spec       string
+		wantPrefix string
+		wantTarget string
+		wantErr    bool
+	}{
+		{spec: "/api=http://127.0.0.1:8000", wantPrefix: "/api", wantTarget: "http://127.0.0.1:8000"},
+		{spec: "/api/=http://127.0.0.1:8000/v2", wantPrefix: "/api", wantTarget: "http://127.0.0.1:8000/v2"},
+		{spec: "/=http://127.0.0.1:8000", wantErr: true},
+		{spec: "api=http://127.0.0.1:8000", wantErr: true},
+		{spec: "/api", wantErr: true},
+		{spec: "/api=127.0.0.1:8000", wantErr: true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := ParseRule(tc.spec)
+			testboil.FailTestIfDiff(t, err != nil, tc.wantErr)
+			if err != nil {
+				return
+			}
+			testboil.FailTestIfDiff(t, got.Prefix, tc.wantPrefix)
+			testboil.FailTestIfDiff(t, got.Target.String(), tc.wantTarget)
+		})
+	}
+}
+
+func TestRule_Handler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI()+" "+r.Host+" "+r.Header.Get("X-Forwarded-Host"))
+	}))
+	t.Cleanup(backend.Close)
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	for _, tc := range []struct {
+		desc         string
+		target       string
+		preserveHost bool
+		urlPath      string
+		want         string
+	}{
+		{desc: "it should forward the path as it is to targets without a path", target: backend.URL, urlPath: "/api/users?id=1", want: "/api/users?id=1 " + backendHost + " dev.local"},
+		{desc: "it should replace the prefix by the path of the target", target: backend.URL + "/", urlPath: "/api/users", want: "/users " + backendHost + " dev.local"},
+		{desc: "it should join the rest onto the path of the target", target: backend.URL + "/v2", urlPath: "/api/users%2Fall", want: "/v2/users%2Fall " + backendHost + " dev.local"},
+		{desc: "it should forward the prefix itself", target: backend.URL + "/v2", urlPath: "/api", want: "/v2 " + backendHost + " dev.local"},
+		{desc: "it should preserve the host if set to", target: backend.URL, preserveHost: true, urlPath: "/api", want: "/api dev.local dev.local"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rule, err := ParseRule("/api=" + tc.target)
+			if err != nil {
+				t.Fatalf("failed to parse rule: %v", err)
+			}
+			rule.PreserveHost = tc.preserveHost
+			rec := httptest.NewRecorder()
+			rule.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://dev.local"+tc.urlPath, nil))
+			testboil.FailTestIfDiff(t, rec.Body.String(), tc.want)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Run("it should forward the request, joined onto the target path", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.Path+"?"+r.URL.RawQuery+" "+r.Header.Get("X-Forwarded-Host"))
+		}))
+		t.Cleanup(backend.Close)
+		target, _ := ParseTarget(backend.URL + "/app")
+		rec := httptest.NewRecorder()
+		New(target).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://dev.local/page?q=1", nil))
+		testboil.FailTestIfDiff(t, rec.Body.String(), "/app/page?q=1 dev.local")
+	})
+
+	t.Run("it should respond with bad gateway when the backend is down", func(t *testing.T) {
+		backend := httptest.NewServer(http.NotFoundHandler())
+		target, _ := ParseTarget(backend.URL)
+		backend.Close()
+		rec := httptest.NewRecorder()
+		New(target).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.FailTestIfDiff(t, rec.Code, http.StatusBadGateway)
+	})
+}
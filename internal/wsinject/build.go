@@ -0,0 +1,134 @@
+package wsinject
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+)
+
+// buildSeparator separates the glob from the command in build command specs
+const buildSeparator = "->"
+
+// buildCommand is run before reloading, when a file matching its glob has changed
+type buildCommand struct {
+	glob    *ignorer
+	pattern string
+	command string
+}
+
+// parseBuildCommand parses specs such as '*.scss -> sass style.scss style.css'. The glob
+// is gitignore-styled, relative to the served directory.
+func parseBuildCommand(spec string) (buildCommand, error) {
+	pattern, command, found := strings.Cut(spec, buildSeparator)
+	pattern = strings.TrimSpace(pattern)
+	command = strings.TrimSpace(command)
+	if !found || pattern == "" || command == "" {
+		return buildCommand{}, fmt.Errorf("invalid build command: '%v', expected '<glob> %v <command>'", spec, buildSeparator)
+	}
+	glob := &ignorer{}
+	glob.add(pattern)
+	return buildCommand{glob: glob, pattern: pattern, command: command}, nil
+}
+
+// buildState keeps the latest build failure, so that it may be shown to browsers which
+// connect while it's failing
+type buildState struct {
+	mu      sync.Mutex
+	failure *message
+}
+
+func (b *buildState) set(failure *message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failure = failure
+}
+
+// clear the failure if it was caused by one of the commands, which have since succeeded
+func (b *buildState) clear(succeeded []string) (cleared bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failure == nil || !slices.Contains(succeeded, b.failure.Command) {
+		return false
+	}
+	b.failure = nil
+	return true
+}
+
+func (b *buildState) get() *message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failure
+}
+
+func (fs *Fileserver) setupBuildCommands() error {
+	fs.builds = nil
+	for _, spec := range fs.buildSpecs {
+		b, err := parseBuildCommand(spec)
+		if err != nil {
+			return err
+		}
+		fs.builds = append(fs.builds, b)
+	}
+	return nil
+}
+
+// build runs every build command matching any of the changes, in the order they were
+// set. Returns false if any of them fails, in which case the failure is sent to the
+// browsers instead of the changes. The failure is cleared once the failing command has
+// been re-run by a matching change, and succeeded.
+func (fs *Fileserver) build(ctx context.Context, changes []change) bool {
+	var succeeded []string
+	for _, b := range fs.builds {
+		if !b.matchesAny(fs, changes) {
+			continue
+		}
+		ancli.PrintfNotice("running build command: '%v'", b.command)
+		output, err := b.run(ctx, fs.masterPath)
+		if err != nil {
+			ancli.Errf("build command: '%v' failed: %v\n%s", b.command, err, output)
+			failure := message{Type: msgBuildFailed, Command: b.command, Output: string(output), Error: err.Error()}
+			fs.buildState.set(&failure)
+			fs.pageReloadChan <- failure
+			return false
+		}
+		ancli.Okf("build command: '%v' succeeded", b.command)
+		succeeded = append(succeeded, b.command)
+	}
+	if fs.buildState.clear(succeeded) {
+		fs.pageReloadChan <- message{Type: msgBuildOK}
+	}
+	return true
+}
+
+func (b buildCommand) matchesAny(fs *Fileserver, changes []change) bool {
+	for _, c := range changes {
+		if b.glob.match(fs.relPath(c.Path), false) {
+			return true
+		}
+	}
+	return false
+}
+
+// run the command within dir, using the shell of the platform, and return its
+// combined output
+func (b buildCommand) run(ctx context.Context, dir string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", b.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", b.command)
+	}
+	cmd.Dir = dir
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.Bytes(), err
+}
@@ -0,0 +1,145 @@
+package wsinject
+
+import (
+	"context"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_parseBuildCommand(t *testing.T) {
+	for _, tc := range []struct {
+		spec        string
+		wantPattern string
+		wantCommand string
+		wantErr     bool
+	}{
+		{spec: "*.scss -> sass style.scss style.css", wantPattern: "*.scss", wantCommand: "sass style.scss style.css"},
+		{spec: "src/**/*.ts->tsc -p .", wantPattern: "src/**/*.ts", wantCommand: "tsc -p ."},
+		{spec: "*.go -> GOOS=js go build -o main.wasm && echo done", wantPattern: "*.go", wantCommand: "GOOS=js go build -o main.wasm && echo done"},
+		{spec: "*.scss", wantErr: true},
+		{spec: "-> sass", wantErr: true},
+		{spec: "*.scss ->", wantErr: true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := parseBuildCommand(tc.spec)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			testboil.FailTestIfDiff(t, got.pattern, tc.wantPattern)
+			testboil.FailTestIfDiff(t, got.command, tc.wantCommand)
+		})
+	}
+}
+
+func Test_build(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("build commands are run using sh in these tests")
+	}
+	setup := func(t *testing.T, specs ...string) (*Fileserver, chan message) {
+		t.Helper()
+		fs := NewFileServer("/delta-streamer-ws", false, WithBuildCommands(specs...))
+		fs.masterPath = t.TempDir()
+		err := fs.setupBuildCommands()
+		if err != nil {
+			t.Fatalf("failed to setup build commands: %v", err)
+		}
+		c := make(chan message, 10)
+		fs.registerWs("mock", c)
+		return fs, c
+	}
+
+	await := func(t *testing.T, c chan message) message {
+		t.Helper()
+		select {
+		case msg := <-c:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("failed to receive message within time")
+		}
+		return message{}
+	}
+
+	t.Run("it should run commands matching the changes within the served directory", func(t *testing.T) {
+		fs, _ := setup(t, "*.scss -> echo built > out.css", "*.ts -> echo ts > out.js")
+		ok := fs.build(context.Background(), []change{{Path: path.Join(fs.masterPath, "styles", "main.scss"), Kind: changeWrite}})
+		if !ok {
+			t.Fatal("expected build to succeed")
+		}
+		b, err := os.ReadFile(path.Join(fs.masterPath, "out.css"))
+		if err != nil {
+			t.Fatalf("expected build command to have run: %v", err)
+		}
+		testboil.FailTestIfDiff(t, string(b), "built\n")
+		_, err = os.Stat(path.Join(fs.masterPath, "out.js"))
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected non-matching build command not to run, got err: %v", err)
+		}
+	})
+
+	t.Run("it should send failures, and clear them on the next success", func(t *testing.T) {
+		fs, c := setup(t, "*.scss -> echo compiling; test -f fixed")
+		changes := []change{{Path: path.Join(fs.masterPath, "main.scss"), Kind: changeWrite}}
+		if fs.build(context.Background(), changes) {
+			t.Fatal("expected build to fail")
+		}
+		got := await(t, c)
+		testboil.FailTestIfDiff(t, got.Type, msgBuildFailed)
+		testboil.FailTestIfDiff(t, got.Command, "echo compiling; test -f fixed")
+		testboil.FailTestIfDiff(t, got.Output, "compiling\n")
+		if fs.buildState.get() == nil {
+			t.Fatal("expected failure to be kept for new clients")
+		}
+
+		os.WriteFile(path.Join(fs.masterPath, "fixed"), nil, 0o644)
+		if !fs.build(context.Background(), changes) {
+			t.Fatal("expected build to succeed")
+		}
+		got = await(t, c)
+		testboil.FailTestIfDiff(t, got.Type, msgBuildOK)
+		if fs.buildState.get() != nil {
+			t.Fatal("expected failure to be cleared")
+		}
+	})
+
+	t.Run("it should keep failures until the failing command succeeds", func(t *testing.T) {
+		fs, c := setup(t, "*.scss -> test -f fixed", "*.ts -> true")
+		if fs.build(context.Background(), []change{{Path: path.Join(fs.masterPath, "main.scss"), Kind: changeWrite}}) {
+			t.Fatal("expected build to fail")
+		}
+		testboil.FailTestIfDiff(t, await(t, c).Type, msgBuildFailed)
+
+		for _, unrelated := range []string{"index.html", "main.ts"} {
+			fs.build(context.Background(), []change{{Path: path.Join(fs.masterPath, unrelated), Kind: changeWrite}})
+			if fs.buildState.get() == nil {
+				t.Fatalf("expected failure to be kept after change of: '%v'", unrelated)
+			}
+		}
+		select {
+		case got := <-c:
+			t.Fatalf("expected no build-ok, got: %v", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("it should withhold the reload of failed builds", func(t *testing.T) {
+		fs, c := setup(t, "*.scss -> false")
+		fs.notifyPageUpdate(context.Background(), change{Path: path.Join(fs.masterPath, "main.scss"), Kind: changeWrite})
+		testboil.FailTestIfDiff(t, await(t, c).Type, msgBuildFailed)
+		select {
+		case got := <-c:
+			t.Fatalf("expected no reload, got: %v", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
@@ -1,83 +1,215 @@
 package wsinject
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
-	"github.com/baalimago/go_away_boilerplate/pkg/threadsafe"
 	"golang.org/x/net/websocket"
 )
 
-// WsHandler sends page reload notifications to the connected websocket
+const (
+	// handshakeTimeout is how long the client has to send its hello
+	handshakeTimeout = 10 * time.Second
+	// dispatchTimeout is how long the dispatcher waits for a client to accept an update
+	dispatchTimeout = time.Second
+)
+
+// WsHandler sends page reload notifications to the connected websocket, once the
+// client and server have agreed on a protocol version, and prints the console output
+// forwarded by the client
 func (fs *Fileserver) WsHandler(ws *websocket.Conn) {
-	reloadChan := make(chan string)
-	killChan := make(chan struct{})
+	// Buffered so that a slow client doesn't hold back the others
+	reloadChan := make(chan message, 8)
+	done := make(chan struct{})
+	disconnect := sync.OnceFunc(func() { close(done) })
 	name := "ws-" + fmt.Sprintf("%v", rand.Int())
+	defer func() {
+		err := ws.Close()
+		if err != nil {
+			ancli.Errf("ws-listener: '%v' got err when closing: %v", name, err)
+		}
+	}()
+
+	version, err := fs.handshake(ws)
+	if err != nil {
+		ancli.Errf("ws-listener: '%v' handshake failed: %v", name, err)
+		msgType := msgError
+		if errors.Is(err, errIncompatible) {
+			msgType = msgIncompatible
+		}
+		websocket.JSON.Send(ws, message{Version: protocolVersion, Type: msgType, Error: err.Error()})
+		return
+	}
+	// Changes after this point are sent by the dispatcher, the client detects any
+	// change in between as a gap in the sequence
+	welcome := message{Version: version, Type: msgWelcome, Instance: fs.instanceID, Seq: fs.seq.Load()}
+	err = websocket.JSON.Send(ws, welcome)
+	if err != nil {
+		ancli.Errf("ws-listener: '%v' failed to send welcome: %v", name, err)
+		return
+	}
+	if failure := fs.buildState.get(); failure != nil {
+		// Show the failing build to clients which connect after it failed
+		f := *failure
+		f.Version = version
+		websocket.JSON.Send(ws, f)
+	}
+	client := clientIdentity(name, ws.Request())
 
 	go func() {
-		ancli.Okf("new websocket connection: '%v'", ws.Config().Origin)
+		ancli.Okf("new websocket connection: '%v', protocol version: %v", client, version)
 		for {
-			pageToReload, ok := <-reloadChan
-			if !ok {
-				killChan <- struct{}{}
+			select {
+			case <-done:
+				return
+			case msg, ok := <-reloadChan:
+				if !ok {
+					disconnect()
+					return
+				}
+				msg.Version = version
+				err := websocket.JSON.Send(ws, msg)
+				if err != nil {
+					// Exit on error
+					ancli.Errf("ws: failed to send message via ws: %v", err)
+					disconnect()
+					return
+				}
 			}
-			err := websocket.Message.Send(ws, pageToReload)
+		}
+	}()
+
+	go func() {
+		for {
+			var msg message
+			err := websocket.JSON.Receive(ws, &msg)
 			if err != nil {
-				// Exit on error
-				ancli.Errf("ws: failed to send message via ws: %v", err)
-				killChan <- struct{}{}
+				// Closed by the client, or broken
+				disconnect()
+				return
+			}
+			if msg.Type == msgConsole {
+				printConsole(client, msg)
 			}
 		}
 	}()
 
 	ancli.Okf("Listening to file changes on pageReloadChan")
 	fs.registerWs(name, reloadChan)
-	<-killChan
-	ancli.Okf("websocket disconnected")
+	<-done
+	ancli.Okf("websocket disconnected: '%v'", client)
 	fs.deregisterWs(name)
-	err := ws.WriteClose(1005)
+	err = ws.WriteClose(1005)
 	if err != nil {
 		ancli.Errf("ws-listener: '%v' got err when writeclosing: %v", name, err)
 	}
-	err = ws.Close()
-	if err != nil {
-		ancli.Errf("ws-listener: '%v' got err when closing: %v", name, err)
+}
+
+// clientIdentity names the client by connection and address, so that output of
+// several browsers may be told apart
+func clientIdentity(name string, r *http.Request) string {
+	if r == nil {
+		return name
 	}
+	return fmt.Sprintf("%v@%v", name, r.RemoteAddr)
 }
 
-func (fs *Fileserver) registerWs(name string, c chan string) {
-	if !threadsafe.Read(fs.wsDispatcherStartedMu, fs.wsDispatcherStarted) {
-		go fs.wsDispatcherStart()
-		threadsafe.Write(fs.wsDispatcherStartedMu, true, fs.wsDispatcherStarted)
+// consoleOutput formats console output forwarded by a client
+func consoleOutput(client string, msg message) string {
+	out := fmt.Sprintf("[%v] %v: %v", client, msg.URL, strings.Join(msg.Args, " "))
+	if msg.Stack != "" {
+		out += "\n" + msg.Stack
+	}
+	return out
+}
+
+// printConsole output forwarded by a client, on the level it was logged on
+func printConsole(client string, msg message) {
+	out := consoleOutput(client, msg)
+	switch msg.Level {
+	case "error":
+		ancli.Errf("%v", out)
+	case "warn":
+		ancli.Warnf("%v", out)
+	default:
+		ancli.Noticef("%v", out)
+	}
+}
+
+// handshake receives the hello of the client and returns the agreed protocol version
+func (fs *Fileserver) handshake(ws *websocket.Conn) (int, error) {
+	err := ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return 0, fmt.Errorf("failed to set handshake deadline: %w", err)
+	}
+	var hello message
+	err = websocket.JSON.Receive(ws, &hello)
+	if err != nil {
+		return 0, fmt.Errorf("failed to receive hello: %w", err)
 	}
+	err = ws.SetReadDeadline(time.Time{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear handshake deadline: %w", err)
+	}
+	return negotiateVersion(hello)
+}
+
+func (fs *Fileserver) registerWs(name string, c chan message) {
+	fs.ensureWsDispatcher()
 	ancli.PrintfNotice("registering: '%v'", name)
 	fs.wsDispatcher.Store(name, c)
 }
 
+// ensureWsDispatcher starts the dispatcher, unless it's already running
+func (fs *Fileserver) ensureWsDispatcher() {
+	fs.wsDispatcherStartedMu.Lock()
+	defer fs.wsDispatcherStartedMu.Unlock()
+	if !*fs.wsDispatcherStarted {
+		go fs.wsDispatcherStart()
+		*fs.wsDispatcherStarted = true
+	}
+}
+
 func (fs *Fileserver) deregisterWs(name string) {
 	fs.wsDispatcher.Delete(name)
 }
 
 func (fs *Fileserver) wsDispatcherStart() {
 	for {
-		pageToReload, ok := <-fs.pageReloadChan
+		msg, ok := <-fs.pageReloadChan
 		if !ok {
 			ancli.PrintNotice("stopping wsDispatcher")
 			fs.wsDispatcher.Range(func(key, value any) bool {
 				ancli.PrintfNotice("sending to: '%v'", key)
-				wsWriterChan := value.(chan string)
+				wsWriterChan := value.(chan message)
 				// Close chan to stop the wsRoutine
 				close(wsWriterChan)
 				return true
 			})
 			return
 		}
-		ancli.PrintfNotice("got update: '%v'", pageToReload)
+		msg.Instance = fs.instanceID
+		if msg.Type == msgChange {
+			// Only changes are sequenced, as they are what clients may miss
+			msg.Seq = fs.seq.Add(1)
+			ancli.PrintfNotice("got update: '%v'", strings.Join(msg.paths(), "', '"))
+		}
 		fs.wsDispatcher.Range(func(key, value any) bool {
 			ancli.PrintfNotice("sending to: '%v'", key)
-			wsWriterChan := value.(chan string)
-			wsWriterChan <- pageToReload
+			wsWriterChan := value.(chan message)
+			select {
+			case wsWriterChan <- msg:
+			case <-time.After(dispatchTimeout):
+				// The client has disconnected, or is stuck. Should it still be alive, it
+				// notices the gap in the sequence and reloads
+				ancli.Warnf("dropping update for unresponsive client: '%v'", key)
+			}
 			return true
 		})
 	}
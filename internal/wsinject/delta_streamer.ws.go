@@ -5,46 +5,511 @@ const deltaStreamerSourceCode = `/**
 * hot reload tool. 
 */
 
+// These are set using string interpolation from the -publicURL flag and websocket path
+// when writing this script
+const publicURL = %v;
+const wsPath = %v;
+// This is set using string interpolation from the -forwardConsole flag
+const forwardConsole = %v;
+// This is set using string interpolation from the -spaFallback flag, if -spa is set
+const spaFallback = %v;
+
+// clientConsole is used for the output of this script, so that it's never forwarded
+const clientConsole = { log: console.log.bind(console), error: console.error.bind(console) };
+
+// websocketURL connects back to the host which served the page, unless a public URL
+// has been set for setups where the page is served through a reverse proxy
+function websocketURL() {
+  const base = new URL(publicURL || location.href);
+  const protocol = base.protocol === 'https:' ? 'wss:' : 'ws:';
+  const prefix = publicURL ? base.pathname.replace(/\/$/, '') : '';
+  return protocol + '//' + base.host + prefix + wsPath;
+}
+
+// sitePath returns the path of url relative to the served root, so that it may be
+// compared with the changed files sent by the server
+function sitePath(url) {
+  let path = new URL(url, location.href).pathname;
+  try {
+    path = decodeURIComponent(path);
+  } catch (e) {
+    // Malformed escapes are compared as-is
+  }
+  const prefix = publicURL ? new URL(publicURL).pathname.replace(/\/$/, '') : '';
+  if (prefix !== '' && path.startsWith(prefix)) {
+    path = path.slice(prefix.length);
+  }
+  return path.startsWith('/') ? path : '/' + path;
+}
+
+// pageFiles returns the files which may have been served for the current page, resolved
+// the way the file server does it: directories serve their index.html, and clean urls
+// may be served from the file with an .html extension. Single page app routes without
+// an extension may also be served the fallback page, when they match no file.
+function pageFiles() {
+  const path = sitePath(location.href);
+  const files = path.endsWith('/') ? [path + 'index.html'] : [path, path + '.html', path + '/index.html'];
+  if (spaFallback !== '' && !/\.[^/]*$/.test(path)) {
+    files.push(spaFallback);
+  }
+  // Error pages are served in place of missing pages and failed requests
+  const status = performance.getEntriesByType('navigation')[0]?.responseStatus;
+  if (status === 404) {
+    files.push('/404.html');
+  } else if (status >= 500) {
+    files.push('/50x.html');
+  }
+  return files;
+}
+
+// isListed checks if the file is an entry of the directory listed by the page, when
+// it's a directory listing
+function isListed(file) {
+  const listing = document.querySelector('meta[name="wd-41-listing"]');
+  if (!listing || !file.startsWith(listing.content) || file === listing.content) {
+    return false;
+  }
+  return !file.slice(listing.content.length).replace(/\/$/, '').includes('/');
+}
+
+// isReferenced checks if the page has loaded the file, either using an element or
+// indirectly, such as via module imports or css @import
+function isReferenced(file) {
+  const elements = document.querySelectorAll('script[src], link[href]');
+  for (const element of elements) {
+    if (sitePath(element.src || element.href) === file) {
+      return true;
+    }
+  }
+  return performance.getEntriesByType('resource').some((entry) => sitePath(entry.name) === file);
+}
+
+// cacheBusted returns url with a query which forces the browser to fetch it again
+function cacheBusted(url) {
+  const busted = new URL(url, location.href);
+  busted.searchParams.set('wd41', Date.now().toString());
+  return busted.href;
+}
+
+// swapImports re-fetches every @import of file within sheet, and the sheets it imports
+function swapImports(sheet, file) {
+  let rules;
+  try {
+    rules = sheet.cssRules;
+  } catch (e) {
+    // Cross-origin stylesheets can't be inspected
+    return false;
+  }
+  let swapped = false;
+  for (let i = 0; i < rules.length; i++) {
+    const rule = rules[i];
+    if (!(rule instanceof CSSImportRule)) {
+      continue;
+    }
+    const href = new URL(rule.href, sheet.href || location.href).href;
+    if (sitePath(href) === file) {
+      const media = rule.media.mediaText;
+      sheet.deleteRule(i);
+      sheet.insertRule('@import url("' + cacheBusted(href) + '")' + (media ? ' ' + media : '') + ';', i);
+      swapped = true;
+    } else if (rule.styleSheet && swapImports(rule.styleSheet, file)) {
+      swapped = true;
+    }
+  }
+  return swapped;
+}
+
+// swapStylesheet re-fetches the stylesheets of file used by the page, without reloading it.
+// Returns false if the page has no matching stylesheet
+function swapStylesheet(file) {
+  let swapped = false;
+  for (const link of document.querySelectorAll('link[rel~="stylesheet"][href]')) {
+    if (link.wd41Stale || sitePath(link.href) !== file) {
+      continue;
+    }
+    // Keep the old stylesheet until the new one has loaded, to not flash unstyled content
+    const next = link.cloneNode();
+    next.href = cacheBusted(link.href);
+    next.addEventListener('load', () => link.remove());
+    next.addEventListener('error', () => link.remove());
+    link.wd41Stale = true;
+    link.after(next);
+    swapped = true;
+  }
+  for (const sheet of document.styleSheets) {
+    if (swapImports(sheet, file)) {
+      swapped = true;
+    }
+  }
+  return swapped;
+}
+
+// mediaFile matches images, fonts, audio and video, which may be swapped in place
+const mediaFile = /\.(png|jpe?g|gif|webp|avif|svg|ico|bmp|woff2?|ttf|otf|eot|mp4|webm|ogg|mp3|wav)$/i;
+
+// bustURLs rewrites every css url() of file in text to a cache-busted url. Relative urls
+// are resolved against base
+function bustURLs(text, base, file) {
+  return text.replace(/url\(\s*(['"]?)([^'")]+)\1\s*\)/g, (match, quote, url) => {
+    const resolved = new URL(url, base).href;
+    return sitePath(resolved) === file ? 'url("' + cacheBusted(resolved) + '")' : match;
+  });
+}
+
+// bustSrcset rewrites the candidates of file within a srcset attribute
+function bustSrcset(srcset, file) {
+  return srcset.split(',').map((candidate) => candidate.trim()).map((candidate) => {
+    const [url, ...descriptors] = candidate.split(/\s+/);
+    if (url === '' || sitePath(url) !== file) {
+      return candidate;
+    }
+    return [cacheBusted(url), ...descriptors].join(' ');
+  }).join(', ');
+}
+
+// swapRuleURLs rewrites the url()s of file within the style declarations of rules, such as
+// background-image and @font-face sources
+function swapRuleURLs(rules, base, file) {
+  let swapped = false;
+  for (const rule of rules) {
+    if (rule.styleSheet) {
+      swapped = swapSheetURLs(rule.styleSheet, file) || swapped;
+    }
+    if (rule.cssRules) {
+      swapped = swapRuleURLs(rule.cssRules, base, file) || swapped;
+    }
+    if (!rule.style) {
+      continue;
+    }
+    for (const property of Array.from(rule.style)) {
+      const value = rule.style.getPropertyValue(property);
+      if (!value.includes('url(')) {
+        continue;
+      }
+      const busted = bustURLs(value, base, file);
+      if (busted !== value) {
+        rule.style.setProperty(property, busted, rule.style.getPropertyPriority(property));
+        swapped = true;
+      }
+    }
+  }
+  return swapped;
+}
+
+function swapSheetURLs(sheet, file) {
+  try {
+    return swapRuleURLs(sheet.cssRules, sheet.href || location.href, file);
+  } catch (e) {
+    // Cross-origin stylesheets can't be inspected
+    return false;
+  }
+}
+
+// swapMedia re-fetches file wherever the page uses it, without reloading it. Returns
+// false if no usage of file is found
+function swapMedia(file) {
+  let swapped = false;
+  for (const element of document.querySelectorAll('[src], [poster], link[rel~="icon"][href]')) {
+    for (const attribute of ['src', 'poster', 'href']) {
+      const value = element.getAttribute(attribute);
+      if (value === null || (attribute === 'href' && element.tagName !== 'LINK') || sitePath(value) !== file) {
+        continue;
+      }
+      element.setAttribute(attribute, cacheBusted(value));
+      // Media elements only pick up new sources once loaded again
+      const media = element.closest('video, audio');
+      if (media) {
+        media.load();
+      }
+      swapped = true;
+    }
+  }
+  for (const element of document.querySelectorAll('[srcset]')) {
+    const srcset = element.getAttribute('srcset');
+    const busted = bustSrcset(srcset, file);
+    if (busted !== srcset) {
+      element.setAttribute('srcset', busted);
+      swapped = true;
+    }
+  }
+  for (const element of document.querySelectorAll('[style*="url("]')) {
+    const style = element.getAttribute('style');
+    const busted = bustURLs(style, location.href, file);
+    if (busted !== style) {
+      element.setAttribute('style', busted);
+      swapped = true;
+    }
+  }
+  for (const sheet of document.styleSheets) {
+    swapped = swapSheetURLs(sheet, file) || swapped;
+  }
+  return swapped;
+}
+
+// hotModules holds the hot replacement handlers registered by the es modules of the page,
+// by file
+const hotModules = new Map();
+
+// hot returns the hot replacement handle of the module at url, usually import.meta.url.
+// A module which accepts updates is re-imported when changed, instead of reloading the page:
+//
+//   import { hot } from '/__wd41/client.js';
+//   const h = hot(import.meta.url);
+//   h.dispose((data) => { data.count = count; });
+//   h.accept((updated) => { updated.render(); });
+export function hot(url) {
+  const file = sitePath(url);
+  if (!hotModules.has(file)) {
+    hotModules.set(file, { url: url, accept: [], dispose: [], data: {} });
+  }
+  const record = hotModules.get(file);
+  return {
+    // data is what the dispose handlers of the previous version of the module left behind
+    data: record.data,
+    accept(handler = () => {}) {
+      record.accept.push(handler);
+    },
+    dispose(handler) {
+      record.dispose.push(handler);
+    },
+  };
+}
+
+// hotReplace re-imports file if it has accepted updates, returns false if it hasn't or
+// if the update failed
+async function hotReplace(file) {
+  const record = hotModules.get(file);
+  if (!record || record.accept.length === 0) {
+    return false;
+  }
+  try {
+    const data = {};
+    for (const handler of record.dispose) {
+      await handler(data);
+    }
+    // The new version registers its own handlers while being imported
+    hotModules.set(file, { url: record.url, accept: [], dispose: [], data: data });
+    const updated = await import(cacheBusted(record.url));
+    for (const handler of record.accept) {
+      await handler(updated);
+    }
+    return true;
+  } catch (e) {
+    clientConsole.error('failed to hot replace: ' + file, e);
+    return false;
+  }
+}
+
+// shouldReload checks if any of the changed files affect the current page. Stylesheets
+// and media are swapped in place, and modules may accept hot replacements, so they only require
+// a reload if they're used in some other way
+async function shouldReload(changedFiles) {
+  const page = pageFiles();
+  let reload = false;
+  for (const changedFile of changedFiles) {
+    if (page.includes(changedFile) || isListed(changedFile)) {
+      reload = true;
+    } else if (changedFile.endsWith('.css')) {
+      reload = (!swapStylesheet(changedFile) && isReferenced(changedFile)) || reload;
+    } else if (mediaFile.test(changedFile)) {
+      reload = (!swapMedia(changedFile) && isReferenced(changedFile)) || reload;
+    } else if (/\.m?js$/.test(changedFile)) {
+      reload = (!(await hotReplace(changedFile)) && isReferenced(changedFile)) || reload;
+    }
+  }
+  return reload;
+}
+
+// protocolVersion of the messages exchanged with the server
+const protocolVersion = 1;
+
+// The server instance and the sequence number of its latest change, used to detect
+// restarts and changes missed while disconnected
+let serverInstance = null;
+let lastSeq = 0;
+// incompatible is set once the server rejects the protocol version, which stops reconnects
+let incompatible = false;
+
+// showBuildFailure covers the page with the output of the failed build command, until
+// the next successful build
+function showBuildFailure(msg) {
+  hideBuildFailure();
+  const host = document.createElement('wd41-build-overlay');
+  // The shadow root keeps the styles of the page and of the overlay apart
+  const root = host.attachShadow({ mode: 'open' });
+  root.innerHTML = '<style>' +
+    ':host { all: initial; position: fixed; inset: 0; z-index: 2147483647; background: rgba(0, 0, 0, 0.85); overflow: auto; }' +
+    'div { margin: 2rem; padding: 1rem 1.5rem; border-top: 4px solid #ff5555; background: #1e1e1e; color: #eee; font: 14px/1.5 monospace; }' +
+    'h1 { margin: 0 0 0.5rem; font-size: 16px; color: #ff5555; }' +
+    'code { color: #8be9fd; }' +
+    'pre { margin: 1rem 0 0; white-space: pre-wrap; word-break: break-word; }' +
+    '</style><div><h1>Build failed</h1><code></code><pre></pre></div>';
+  root.querySelector('code').textContent = '$ ' + msg.command + (msg.error ? ' (' + msg.error + ')' : '');
+  root.querySelector('pre').textContent = msg.output || '';
+  document.documentElement.appendChild(host);
+}
+
+function hideBuildFailure() {
+  for (const overlay of document.querySelectorAll('wd41-build-overlay')) {
+    overlay.remove();
+  }
+}
+
+// handleMessage from the server
+async function handleMessage(socket, msg) {
+  switch (msg.type) {
+    case 'welcome': {
+      const missed = serverInstance !== null && (msg.instance !== serverInstance || (msg.seq || 0) !== lastSeq);
+      serverInstance = msg.instance;
+      lastSeq = msg.seq || 0;
+      if (missed) {
+        location.reload();
+        break;
+      }
+      if (forwardConsole) {
+        consoleSocket = socket;
+        for (const pending of pendingConsole.splice(0)) {
+          socket.send(JSON.stringify(pending));
+        }
+      }
+      break;
+    }
+    case 'change': {
+      // A gap in the sequence means that some change may have been missed
+      const missed = msg.seq !== lastSeq + 1;
+      lastSeq = msg.seq;
+      const changedFiles = msg.changes.map((change) => change.path);
+      // Reload page if it's detected that the current page, or anything it uses, has been altered
+      // This funny-looking comparison is set using string interpolation from the -forceReload flag
+      // when writing this script
+      if (%v === true || missed || await shouldReload(changedFiles)) {
+        location.reload();
+      }
+      break;
+    }
+    case 'build-failed':
+      clientConsole.error('wd-41 build failed: ' + msg.command + '\n' + (msg.output || ''));
+      showBuildFailure(msg);
+      break;
+    case 'build-ok':
+      hideBuildFailure();
+      break;
+    case 'incompatible':
+      clientConsole.error('wd-41 server is incompatible, not reconnecting:', msg.error);
+      incompatible = true;
+      break;
+    case 'error':
+      // The server closes the connection, which is retried as usual
+      clientConsole.error('wd-41 server error:', msg.error);
+      break;
+    default:
+      // Message types added in later protocol versions are ignored
+  }
+}
+
+// The socket which console output is forwarded on, once the handshake is complete
+let consoleSocket = null;
+// pendingConsole holds the output which has been logged before the handshake
+const pendingConsole = [];
+
+// describe a console argument as text
+function describe(arg) {
+  if (arg instanceof Error) {
+    return arg.stack || String(arg);
+  }
+  if (typeof arg === 'string') {
+    return arg;
+  }
+  try {
+    return JSON.stringify(arg) ?? String(arg);
+  } catch (e) {
+    // Such as circular structures
+    return String(arg);
+  }
+}
+
+function sendConsole(level, args, stack) {
+  const msg = {
+    v: protocolVersion,
+    type: 'console',
+    level: level,
+    args: args.map((arg) => describe(arg).slice(0, 10000)),
+    url: location.href,
+    stack: stack || '',
+  };
+  if (consoleSocket === null) {
+    // Keep the latest output until connected
+    pendingConsole.push(msg);
+    if (pendingConsole.length > 100) {
+      pendingConsole.shift();
+    }
+    return;
+  }
+  try {
+    consoleSocket.send(JSON.stringify(msg));
+  } catch (e) {
+    // The socket is closing, the output is lost
+  }
+}
+
+// startConsoleForwarding patches the console and listens for uncaught errors, to send
+// them upstream
+function startConsoleForwarding() {
+  for (const level of ['log', 'info', 'warn', 'error', 'debug']) {
+    const original = console[level].bind(console);
+    console[level] = function (...args) {
+      original(...args);
+      sendConsole(level, args);
+    };
+  }
+  window.addEventListener('error', (event) => {
+    sendConsole('error', ['Uncaught ' + event.message + ' (' + event.filename + ':' + event.lineno + ':' + event.colno + ')'],
+      event.error && event.error.stack);
+  });
+  window.addEventListener('unhandledrejection', (event) => {
+    sendConsole('error', ['Unhandled rejection: ' + describe(event.reason)],
+      event.reason instanceof Error ? event.reason.stack : '');
+  });
+}
+
 function startWebsocket() {
   // Check if the WebSocket object is available in the current context
   if (typeof WebSocket !== 'function') {
-    console.error('WebSocket is not supported by this browser.');
+    clientConsole.error('WebSocket is not supported by this browser.');
     return;
   }
 
   // Establish a connection with the WebSocket server
-  const socket = new WebSocket('ws%v://localhost:%v%v');
+  const socket = new WebSocket(websocketURL());
 
   // Event handler for when the WebSocket connection is established
   socket.addEventListener('open', function (event) {
-    console.log('Connected to the WebSocket server');
+    clientConsole.log('Connected to the WebSocket server');
+    socket.send(JSON.stringify({ v: protocolVersion, type: 'hello', versions: [protocolVersion] }));
   });
 
   // Event handler for when a message is received from the server
   socket.addEventListener('message', function (event) {
-    console.log('Message from server:', event.data);
-    let fileName = window.location.pathname.split('/').pop();
-    if (fileName === "") {
-      fileName = "/index.html"
-    } else {
-      fileName = "/" + fileName
-    }
-    // Reload page if it's detected that the current page has been altered
-    if (event.data === fileName ||
-      // Always reload on js and css files since its difficult to know where these are used
-      event.data.includes(".js") ||
-      event.data.includes(".css") ||
-      // This funny-looking comparison is set using string interpolation from the -forceReload flag
-      // when writing this script
-      % v === true
-    ) {
-      location.reload();
+    clientConsole.log('Message from server:', event.data);
+    let msg;
+    try {
+      msg = JSON.parse(event.data);
+    } catch (e) {
+      clientConsole.error('Malformed message from server:', e);
+      return;
     }
+    handleMessage(socket, msg);
   });
 
   // Event handler for when the WebSocket connection is closed
   socket.addEventListener('close', function (event) {
-    console.log('Disconnected from the WebSocket server');
+    clientConsole.log('Disconnected from the WebSocket server');
+    if (consoleSocket === socket) {
+      consoleSocket = null;
+    }
+    if (incompatible) {
+      return;
+    }
     // The socket is dead. Let's make a new one (and keep trying until wd-41 backend
     // process is back up again)
     setTimeout(startWebsocket, 3000)
@@ -52,9 +517,12 @@ function startWebsocket() {
 
   // Event handler for when an error occurs with the WebSocket connection
   socket.addEventListener('error', function (event) {
-    console.error('WebSocket error:', event);
-    console.error(event.message);
+    clientConsole.error('WebSocket error:', event);
+    clientConsole.error(event.message);
   });
 }
 
+if (forwardConsole) {
+  startConsoleForwarding();
+}
 startWebsocket();`
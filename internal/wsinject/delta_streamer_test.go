@@ -9,16 +9,40 @@ import (
 	"time"
 
 	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
 	"golang.org/x/net/websocket"
 )
 
+func Test_deltaStreamerScript(t *testing.T) {
+	t.Run("it should connect back to the page's own host by default", func(t *testing.T) {
+		fs := NewFileServer("/delta-streamer-ws", false)
+		got := string(fs.deltaStreamerScript())
+		testboil.AssertStringContains(t, got, `const publicURL = "";`)
+		testboil.AssertStringContains(t, got, `const wsPath = "/delta-streamer-ws";`)
+		if strings.Contains(got, "localhost") {
+			t.Fatal("expected no hard-coded localhost in client script")
+		}
+	})
+
+	t.Run("it should interpolate the public url", func(t *testing.T) {
+		fs := NewFileServer("/delta-streamer-ws", false, WithPublicURL("https://dev.example.com/site/"))
+		testboil.AssertStringContains(t, string(fs.deltaStreamerScript()), `const publicURL = "https://dev.example.com/site/";`)
+	})
+
+	t.Run("it should interpolate the single page app fallback", func(t *testing.T) {
+		fs := NewFileServer("/delta-streamer-ws", false, WithSPAFallback("app/index.html"))
+		testboil.AssertStringContains(t, string(fs.deltaStreamerScript()), `const spaFallback = "/app/index.html";`)
+	})
+}
+
 func TestWsHandler(t *testing.T) {
 	ancli.Newline = true
 	setup := func(t *testing.T) (*Fileserver, *websocket.Config, *httptest.Server) {
 		t.Helper()
 		started := false
 		fs := &Fileserver{
-			pageReloadChan:        make(chan string),
+			instanceID:            "test-instance",
+			pageReloadChan:        make(chan message),
 			wsDispatcher:          sync.Map{},
 			wsDispatcherStarted:   &started,
 			wsDispatcherStartedMu: &sync.Mutex{},
@@ -35,31 +59,51 @@ func TestWsHandler(t *testing.T) {
 		return fs, wsConfig, server
 	}
 
-	t.Run("it should send messages posted on pageReloadChan", func(t *testing.T) {
-		fs, wsConfig, testServer := setup(t)
-
+	// connect and complete the handshake
+	connect := func(t *testing.T, wsConfig *websocket.Config) *websocket.Conn {
+		t.Helper()
 		ws, err := websocket.DialConfig(wsConfig)
 		if err != nil {
 			t.Fatalf("Failed to connect to WebSocket: %v", err)
 		}
+		err = websocket.JSON.Send(ws, message{Version: protocolVersion, Type: msgHello, Versions: []int{protocolVersion}})
+		if err != nil {
+			t.Fatalf("Failed to send hello: %v", err)
+		}
+		var welcome message
+		err = websocket.JSON.Receive(ws, &welcome)
+		if err != nil {
+			t.Fatalf("Failed to receive welcome: %v", err)
+		}
+		testboil.FailTestIfDiff(t, welcome.Type, msgWelcome)
+		testboil.FailTestIfDiff(t, welcome.Version, protocolVersion)
+		testboil.FailTestIfDiff(t, welcome.Instance, "test-instance")
+		return ws
+	}
+
+	t.Run("it should send messages posted on pageReloadChan", func(t *testing.T) {
+		fs, wsConfig, testServer := setup(t)
+		ws := connect(t, wsConfig)
 		t.Cleanup(func() {
 			testServer.Close()
 			ws.Close()
 		})
 
 		go func() {
-			fs.pageReloadChan <- "test message"
+			fs.pageReloadChan <- message{Type: msgChange, Changes: []change{{Path: "/index.html", Kind: changeWrite, Hash: "abc"}}}
 		}()
 
-		var msg string
-		err = websocket.Message.Receive(ws, &msg)
+		var msg message
+		err := websocket.JSON.Receive(ws, &msg)
 		if err != nil {
 			t.Fatalf("Failed to receive message: %v", err)
 		}
 
-		if msg != "test message" {
-			t.Fatalf("Expected 'test message', got: %v", msg)
-		}
+		testboil.FailTestIfDiff(t, msg.Type, msgChange)
+		testboil.FailTestIfDiff(t, msg.Version, protocolVersion)
+		testboil.FailTestIfDiff(t, msg.Seq, uint64(1))
+		testboil.FailTestIfDiff(t, msg.Instance, "test-instance")
+		testboil.FailTestIfDiff(t, msg.Changes[0], change{Path: "/index.html", Kind: changeWrite, Hash: "abc"})
 
 		close(fs.pageReloadChan)
 		select {
@@ -69,18 +113,85 @@ func TestWsHandler(t *testing.T) {
 		}
 	})
 
-	t.Run("it should handle multiple connections at once", func(t *testing.T) {
+	t.Run("it should increment the sequence number of every batch", func(t *testing.T) {
 		fs, wsConfig, testServer := setup(t)
+		ws := connect(t, wsConfig)
+		t.Cleanup(func() {
+			testServer.Close()
+			ws.Close()
+		})
 
-		mockWebClient0, err := websocket.DialConfig(wsConfig)
+		go func() {
+			fs.pageReloadChan <- message{Type: msgChange, Changes: []change{{Path: "/a.html", Kind: changeCreate}}}
+			fs.pageReloadChan <- message{Type: msgChange, Changes: []change{{Path: "/a.html", Kind: changeRemove}}}
+		}()
+
+		for _, want := range []uint64{1, 2} {
+			var msg message
+			err := websocket.JSON.Receive(ws, &msg)
+			if err != nil {
+				t.Fatalf("Failed to receive message: %v", err)
+			}
+			testboil.FailTestIfDiff(t, msg.Seq, want)
+		}
+		testboil.FailTestIfDiff(t, fs.seq.Load(), uint64(2))
+	})
+
+	t.Run("it should deregister clients which disconnect", func(t *testing.T) {
+		fs, wsConfig, testServer := setup(t)
+		t.Cleanup(testServer.Close)
+		ws := connect(t, wsConfig)
+		err := websocket.JSON.Send(ws, message{Version: protocolVersion, Type: msgConsole, Level: "log", Args: []string{"hello"}})
 		if err != nil {
-			t.Fatalf("Failed to connect to WebSocket: %v", err)
+			t.Fatalf("Failed to send console message: %v", err)
 		}
+		ws.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			registered := 0
+			fs.wsDispatcher.Range(func(_, _ any) bool {
+				registered++
+				return true
+			})
+			if registered == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected client to be deregistered, still got: %v", registered)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
 
-		mockWebClient1, err := websocket.DialConfig(wsConfig)
+	t.Run("it should reject clients without a supported protocol version", func(t *testing.T) {
+		_, wsConfig, testServer := setup(t)
+		ws, err := websocket.DialConfig(wsConfig)
 		if err != nil {
 			t.Fatalf("Failed to connect to WebSocket: %v", err)
 		}
+		t.Cleanup(func() {
+			testServer.Close()
+			ws.Close()
+		})
+		err = websocket.JSON.Send(ws, message{Version: 99, Type: msgHello, Versions: []int{99}})
+		if err != nil {
+			t.Fatalf("Failed to send hello: %v", err)
+		}
+		var msg message
+		err = websocket.JSON.Receive(ws, &msg)
+		if err != nil {
+			t.Fatalf("Failed to receive message: %v", err)
+		}
+		testboil.FailTestIfDiff(t, msg.Type, msgIncompatible)
+		testboil.AssertStringContains(t, msg.Error, "no supported protocol version")
+	})
+
+	t.Run("it should handle multiple connections at once", func(t *testing.T) {
+		fs, wsConfig, testServer := setup(t)
+
+		mockWebClient0 := connect(t, wsConfig)
+		mockWebClient1 := connect(t, wsConfig)
 
 		t.Cleanup(func() {
 			mockWebClient0.Close()
@@ -92,15 +203,15 @@ func TestWsHandler(t *testing.T) {
 		go func() {
 			mu.Lock()
 			defer mu.Unlock()
-			fs.pageReloadChan <- "test message"
+			fs.pageReloadChan <- message{Type: msgChange, Changes: []change{{Path: "/index.html", Kind: changeWrite}}}
 		}()
 
-		gotMsgChan := make(chan string)
+		gotMsgChan := make(chan message)
 		for _, wsClient := range []*websocket.Conn{mockWebClient0, mockWebClient1} {
 			go func(wsClient *websocket.Conn) {
 				for {
-					var msg string
-					websocket.Message.Receive(wsClient, &msg)
+					var msg message
+					websocket.JSON.Receive(wsClient, &msg)
 					gotMsgChan <- msg
 				}
 			}(wsClient)
@@ -121,3 +232,24 @@ func TestWsHandler(t *testing.T) {
 		mu.Unlock()
 	})
 }
+
+func Test_consoleOutput(t *testing.T) {
+	t.Run("it should include client, page and arguments", func(t *testing.T) {
+		got := consoleOutput("ws-1@10.0.0.2:5000", message{
+			Level: "log",
+			Args:  []string{"count:", "3"},
+			URL:   "http://192.168.1.2:8080/blog/",
+		})
+		testboil.FailTestIfDiff(t, got, "[ws-1@10.0.0.2:5000] http://192.168.1.2:8080/blog/: count: 3")
+	})
+
+	t.Run("it should append the stack trace", func(t *testing.T) {
+		got := consoleOutput("ws-1", message{
+			Level: "error",
+			Args:  []string{"Uncaught TypeError: x is undefined"},
+			URL:   "http://localhost:8080/",
+			Stack: "TypeError: x is undefined\n    at main.js:3:1",
+		})
+		testboil.FailTestIfDiff(t, got, "[ws-1] http://localhost:8080/: Uncaught TypeError: x is undefined\nTypeError: x is undefined\n    at main.js:3:1")
+	})
+}
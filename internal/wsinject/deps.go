@@ -0,0 +1,72 @@
+package wsinject
+
+import (
+	"slices"
+	"sync"
+)
+
+// dependencies tracks which pages are built from which other files, such as layouts,
+// partials and data files, so that a change of any of them reloads the pages as well
+type dependencies struct {
+	mu sync.Mutex
+	// dependents of each file, by page
+	dependents map[string]map[string]struct{}
+}
+
+// set the files which page is built from, replacing the ones set before
+func (d *dependencies) set(page string, files ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dependents == nil {
+		d.dependents = make(map[string]map[string]struct{})
+	}
+	for file, pages := range d.dependents {
+		delete(pages, page)
+		if len(pages) == 0 {
+			delete(d.dependents, file)
+		}
+	}
+	for _, file := range files {
+		if d.dependents[file] == nil {
+			d.dependents[file] = make(map[string]struct{})
+		}
+		d.dependents[file][page] = struct{}{}
+	}
+}
+
+// on returns the files which page is built from, as set, sorted
+func (d *dependencies) on(page string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var files []string
+	for file, pages := range d.dependents {
+		if _, ok := pages[page]; ok {
+			files = append(files, file)
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
+// of returns every page built from file, directly or via other dependencies, sorted
+func (d *dependencies) of(file string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen := map[string]struct{}{file: {}}
+	var pages []string
+	queue := []string{file}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for page := range d.dependents[next] {
+			if _, ok := seen[page]; ok {
+				continue
+			}
+			seen[page] = struct{}{}
+			pages = append(pages, page)
+			queue = append(queue, page)
+		}
+	}
+	slices.Sort(pages)
+	return pages
+}
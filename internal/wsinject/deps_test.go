@@ -0,0 +1,43 @@
+package wsinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_dependencies(t *testing.T) {
+	t.Run("it should return the pages built from a file", func(t *testing.T) {
+		d := dependencies{}
+		d.set("b.html", "layout.html")
+		d.set("a.html", "layout.html", "nav.html")
+		testboil.FailTestIfDiff(t, strings.Join(d.of("layout.html"), ","), "a.html,b.html")
+		testboil.FailTestIfDiff(t, strings.Join(d.of("nav.html"), ","), "a.html")
+		testboil.FailTestIfDiff(t, len(d.of("a.html")), 0)
+	})
+
+	t.Run("it should return the files a page is built from", func(t *testing.T) {
+		d := dependencies{}
+		d.set("a.html", "nav.html", "layout.html")
+		d.set("b.html", "footer.html")
+		testboil.FailTestIfDiff(t, strings.Join(d.on("a.html"), ","), "layout.html,nav.html")
+		testboil.FailTestIfDiff(t, len(d.on("layout.html")), 0)
+	})
+
+	t.Run("it should replace the dependencies of a page", func(t *testing.T) {
+		d := dependencies{}
+		d.set("a.html", "nav.html")
+		d.set("a.html", "footer.html")
+		testboil.FailTestIfDiff(t, len(d.of("nav.html")), 0)
+		testboil.FailTestIfDiff(t, strings.Join(d.of("footer.html"), ","), "a.html")
+	})
+
+	t.Run("it should follow dependencies transitively, without looping", func(t *testing.T) {
+		d := dependencies{}
+		d.set("nav.html", "links.html")
+		d.set("a.html", "nav.html")
+		d.set("links.html", "a.html")
+		testboil.FailTestIfDiff(t, strings.Join(d.of("links.html"), ","), "a.html,nav.html")
+	})
+}
@@ -0,0 +1,110 @@
+package wsinject
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	notFoundPage    = "404.html"
+	serverErrorPage = "50x.html"
+)
+
+// ErrorPageHandler replaces the not found and server error responses of next with the
+// 404.html and 50x.html pages at the root of the served directory, if they exist.
+// The pages keep the status code of the response, and get the delta-streamer script
+// injected.
+func (fs *Fileserver) ErrorPageHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorPageWriter{ResponseWriter: w, fs: fs}
+		next.ServeHTTP(ew, r)
+		if ew.page == nil {
+			return
+		}
+		h := w.Header()
+		h.Del("Content-Encoding")
+		h.Del("ETag")
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Content-Length", strconv.Itoa(len(ew.page)))
+		w.WriteHeader(ew.status)
+		if r.Method != http.MethodHead {
+			w.Write(ew.page)
+		}
+	})
+}
+
+// errorPage returns the injected error page for the status, if there is one
+func (fs *Fileserver) errorPage(status int) ([]byte, bool) {
+	var name string
+	switch {
+	case status == http.StatusNotFound:
+		name = notFoundPage
+	case status >= http.StatusInternalServerError:
+		name = serverErrorPage
+	default:
+		return nil, false
+	}
+	origPath := filepath.Join(fs.masterPath, name)
+	if fs.isIgnored(origPath, false) {
+		return nil, false
+	}
+	b, err := os.ReadFile(origPath)
+	if err != nil {
+		return nil, false
+	}
+	return fs.injectRendered(name, fs.expandIncludes(origPath, b)), true
+}
+
+// errorPageWriter discards the response if there is an error page for its status
+type errorPageWriter struct {
+	http.ResponseWriter
+	fs *Fileserver
+
+	wroteHeader bool
+	status      int
+	// page replacing the response, if any
+	page []byte
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	ew.status = status
+	if page, ok := ew.fs.errorPage(status); ok {
+		ew.page = page
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorPageWriter) Write(b []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.page != nil {
+		return len(b), nil
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+// Flush passes through, unless the response is being replaced
+func (ew *errorPageWriter) Flush() {
+	if ew.page != nil {
+		return
+	}
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
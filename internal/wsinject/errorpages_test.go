@@ -0,0 +1,69 @@
+package wsinject
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func TestErrorPageHandler(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(path.Join(root, "index.html"), []byte("<html><head></head><body>index</body></html>"), 0o644)
+	os.WriteFile(path.Join(root, "404.html"), []byte("<html><head></head><body>custom not found</body></html>"), 0o644)
+	fs := NewFileServer("/delta-streamer-ws", false)
+	fs.masterPath = root
+	fs.setupIgnorer()
+	h := fs.ErrorPageHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			http.Error(w, "boom", http.StatusBadGateway)
+		case "/forbidden":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			http.FileServer(http.Dir(root)).ServeHTTP(w, r)
+		}
+	}))
+
+	for _, tc := range []struct {
+		desc     string
+		urlPath  string
+		wantCode int
+		want     string
+	}{
+		{desc: "it should serve the injected 404.html on missing files", urlPath: "/missing.html", wantCode: http.StatusNotFound, want: "custom not found"},
+		{desc: "it should keep the status of server errors without a 50x.html", urlPath: "/fail", wantCode: http.StatusBadGateway, want: "boom"},
+		{desc: "it should leave other errors as they are", urlPath: "/forbidden", wantCode: http.StatusForbidden, want: "forbidden"},
+		{desc: "it should leave found files as they are", urlPath: "/", wantCode: http.StatusOK, want: "index"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.urlPath, nil))
+			testboil.FailTestIfDiff(t, rec.Code, tc.wantCode)
+			b, _ := io.ReadAll(rec.Body)
+			testboil.AssertStringContains(t, string(b), tc.want)
+		})
+	}
+
+	t.Run("it should serve the injected 50x.html on server errors", func(t *testing.T) {
+		os.WriteFile(path.Join(root, "50x.html"), []byte("<html><head></head><body>custom error</body></html>"), 0o644)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fail", nil))
+		testboil.FailTestIfDiff(t, rec.Code, http.StatusBadGateway)
+		testboil.FailTestIfDiff(t, rec.Header().Get("Content-Type"), "text/html; charset=utf-8")
+		b, _ := io.ReadAll(rec.Body)
+		testboil.AssertStringContains(t, string(b), "custom error")
+		testboil.AssertStringContains(t, string(b), ClientScriptPath)
+	})
+
+	t.Run("it should not write a body on head requests", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/missing.html", nil))
+		testboil.FailTestIfDiff(t, rec.Code, http.StatusNotFound)
+		testboil.FailTestIfDiff(t, rec.Body.Len(), 0)
+	})
+}
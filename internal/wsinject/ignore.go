@@ -0,0 +1,177 @@
+package wsinject
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const wd41IgnoreFile = ".wd41ignore"
+
+// defaultIgnorePatterns are always ignored, unless negated by some later pattern.
+// They cover version control and the swap and backup files of common editors
+var defaultIgnorePatterns = []string{
+	".git/",
+	"*.swp",
+	"*.swx",
+	"*~",
+	".#*",
+	"#*#",
+}
+
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignorer matches paths relative to master against gitignore-styled glob patterns.
+// Later patterns take precedence over earlier ones, and a path within an ignored
+// directory is always ignored.
+type ignorer struct {
+	rules []ignoreRule
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	r := ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A leading '**/' anchors the pattern as well, and is matched by globMatch against
+	// any number of leading directories
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	r.pattern = line
+	return r, true
+}
+
+func (ig *ignorer) add(patterns ...string) {
+	for _, p := range patterns {
+		if r, ok := parseIgnoreRule(p); ok {
+			ig.rules = append(ig.rules, r)
+		}
+	}
+}
+
+// addFile adds all patterns of the ignore file at filePath, if it exists
+func (ig *ignorer) addFile(filePath string) error {
+	f, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open ignore file: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ig.add(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ignore file: '%v', err: %w", filePath, err)
+	}
+	return nil
+}
+
+// match the slash separated relPath. Every parent directory is matched as well, since
+// the content of ignored directories can't be re-included.
+func (ig *ignorer) match(relPath string, isDir bool) bool {
+	if ig == nil || relPath == "." || relPath == "" {
+		return false
+	}
+	segments := strings.Split(relPath, "/")
+	for i := 1; i < len(segments); i++ {
+		if ig.matchRules(segments[:i], true) {
+			return true
+		}
+	}
+	return ig.matchRules(segments, isDir)
+}
+
+func (ig *ignorer) matchRules(segments []string, isDir bool) bool {
+	ignored := false
+	for _, r := range ig.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		var hit bool
+		if r.anchored {
+			hit = globMatch(strings.Split(r.pattern, "/"), segments)
+		} else {
+			hit = globMatch(strings.Split(r.pattern, "/"), segments[len(segments)-1:])
+		}
+		if hit {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// globMatch the pattern segments against the path segments, where '**' matches
+// zero or more segments and every other segment is matched as by path.Match
+func globMatch(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if globMatch(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], segments[0])
+	if err != nil || !ok {
+		return false
+	}
+	return globMatch(pattern[1:], segments[1:])
+}
+
+// setupIgnorer reads the ignore files at the root of master. Precedence, from lowest
+// to highest: defaults, .gitignore, .wd41ignore and then patterns set using WithIgnore.
+func (fs *Fileserver) setupIgnorer() error {
+	ig := &ignorer{}
+	ig.add(defaultIgnorePatterns...)
+	ignoreFiles := []string{wd41IgnoreFile}
+	if fs.respectGitignore {
+		ignoreFiles = append([]string{".gitignore"}, ignoreFiles...)
+	}
+	for _, ignoreFile := range ignoreFiles {
+		err := ig.addFile(filepath.Join(fs.masterPath, ignoreFile))
+		if err != nil {
+			return err
+		}
+	}
+	ig.add(fs.ignorePatterns...)
+	fs.ignore = ig
+	return nil
+}
+
+// isIgnored checks if the path within master should be excluded from the mirror, the
+// watcher and the event stream
+func (fs *Fileserver) isIgnored(origPath string, isDir bool) bool {
+	return fs.ignore.match(fs.relPath(origPath), isDir)
+}
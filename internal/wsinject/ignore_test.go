@@ -0,0 +1,118 @@
+package wsinject
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func Test_ignorer(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		relPath  string
+		isDir    bool
+		want     bool
+	}{
+		{"it should match basename at any depth", []string{"*.log"}, "a/b/debug.log", false, true},
+		{"it should not match other extensions", []string{"*.log"}, "a/b/debug.html", false, false},
+		{"it should match files within ignored directories", []string{"node_modules"}, "node_modules/pkg/index.js", false, true},
+		{"it should only match directories on trailing slash", []string{"build/"}, "build", false, false},
+		{"it should match directories on trailing slash", []string{"build/"}, "build", true, true},
+		{"it should anchor patterns with leading slash", []string{"/out"}, "nested/out", true, false},
+		{"it should match anchored patterns at root", []string{"/out"}, "out", true, true},
+		{"it should anchor patterns containing slash", []string{"docs/*.md"}, "docs/readme.md", false, true},
+		{"it should not match anchored patterns elsewhere", []string{"docs/*.md"}, "a/docs/readme.md", false, false},
+		{"it should match double star at any depth", []string{"a/**/z.txt"}, "a/b/c/z.txt", false, true},
+		{"it should match double star with zero segments", []string{"a/**/z.txt"}, "a/z.txt", false, true},
+		{"it should match leading double star anywhere", []string{"**/cache"}, "x/y/cache", true, true},
+		{"it should match leading double star at the root", []string{"**/cache"}, "cache", true, true},
+		{"it should match leading double star with a nested pattern", []string{"**/foo/bar"}, "foo/bar", false, true},
+		{"it should match leading double star with a nested pattern at any depth", []string{"**/foo/bar"}, "x/y/foo/bar", false, true},
+		{"it should not match leading double star with a nested pattern partially", []string{"**/foo/bar"}, "foo/x/bar", false, false},
+		{"it should match within directories of leading double star patterns", []string{"**/foo/bar"}, "x/foo/bar/baz.txt", false, true},
+		{"it should re-include negated patterns", []string{"*.html", "!index.html"}, "index.html", false, false},
+		{"it should let later patterns win", []string{"!index.html", "*.html"}, "index.html", false, true},
+		{"it should skip comments and blank lines", []string{"# *.html", ""}, "index.html", false, false},
+		{"it should never match root", []string{"*"}, ".", true, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ig := &ignorer{}
+			ig.add(tc.patterns...)
+			got := ig.match(tc.relPath, tc.isDir)
+			if got != tc.want {
+				t.Fatalf("patterns: %v, path: '%v', expected: %v, got: %v", tc.patterns, tc.relPath, tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_Setup_ignore(t *testing.T) {
+	tmpDir := t.TempDir()
+	write := func(t *testing.T, relPath, content string) {
+		t.Helper()
+		p := path.Join(tmpDir, relPath)
+		err := os.MkdirAll(path.Dir(p), 0o777)
+		if err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		err = os.WriteFile(p, []byte(content), 0o777)
+		if err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	write(t, ".git/HEAD", "ref: refs/heads/main")
+	write(t, ".gitignore", "node_modules/\n")
+	write(t, wd41IgnoreFile, "*.bin\n")
+	write(t, "node_modules/pkg/index.js", "")
+	write(t, "video.bin", "")
+	write(t, "draft.html", mockHtml)
+	write(t, "index.html", mockHtml)
+	write(t, ".index.html.swp", "")
+
+	fs := NewFileServer("/delta-streamer-ws.js", false, WithIgnore("draft.html"))
+	setupFileServer(t, fs, tmpDir)
+
+	for _, ignored := range []string{".git", "node_modules", "video.bin", "draft.html", ".index.html.swp"} {
+		t.Run("it should not mirror: "+ignored, func(t *testing.T) {
+			_, err := os.Stat(path.Join(fs.mirrorPath, ignored))
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected '%v' to not be mirrored, got err: %v", ignored, err)
+			}
+		})
+	}
+
+	t.Run("it should mirror files which aren't ignored", func(t *testing.T) {
+		_, err := os.Stat(path.Join(fs.mirrorPath, "index.html"))
+		if err != nil {
+			t.Fatalf("expected index.html to be mirrored, got err: %v", err)
+		}
+	})
+
+	t.Run("it should not watch ignored directories", func(t *testing.T) {
+		for _, watched := range fs.watcher.WatchList() {
+			if watched == path.Join(tmpDir, "node_modules") || watched == path.Join(tmpDir, ".git") {
+				t.Fatalf("expected ignored directory to not be watched: '%v'", watched)
+			}
+		}
+	})
+
+	t.Run("it should skip events of ignored paths", func(t *testing.T) {
+		got := fs.handleFileEvent(fsnotify.Event{Name: path.Join(tmpDir, "draft.html"), Op: fsnotify.Write})
+		if len(got) != 0 {
+			t.Fatalf("expected no changes, got: %v", got)
+		}
+	})
+
+	t.Run("it should respect gitignore toggle", func(t *testing.T) {
+		fs := NewFileServer("/delta-streamer-ws.js", false, WithGitignore(false))
+		setupFileServer(t, fs, tmpDir)
+		_, err := os.Stat(path.Join(fs.mirrorPath, "node_modules", "pkg", "index.js"))
+		if err != nil {
+			t.Fatalf("expected node_modules to be mirrored when gitignore is disabled, got err: %v", err)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package wsinject
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+)
+
+// maxIncludeDepth limits how deeply includes may be nested
+const maxIncludeDepth = 16
+
+// includeDirective matches server side includes, such as <!--#include file="nav.html" -->.
+// 'file' is relative to the including file, 'virtual' to the root of the served directory.
+var includeDirective = regexp.MustCompile(`<!--#include\s+(file|virtual)="([^"]+)"\s*-->`)
+
+// expandIncludes replaces the include directives of the html page at origPath with the
+// content of the included files, recursively. The page is set to depend on every
+// included file, so that it's rebuilt when any of them changes.
+func (fs *Fileserver) expandIncludes(origPath string, b []byte) []byte {
+	if !bytes.Contains(b, []byte("<!--#include")) || !isHTML(origPath, b) {
+		return b
+	}
+	var included []string
+	expanded := fs.expand(origPath, b, []string{origPath}, &included)
+	fs.deps.set(origPath, included...)
+	return expanded
+}
+
+func (fs *Fileserver) expand(origPath string, b []byte, stack []string, included *[]string) []byte {
+	return includeDirective.ReplaceAllFunc(b, func(directive []byte) []byte {
+		m := includeDirective.FindSubmatch(directive)
+		target, err := fs.includeTarget(origPath, string(m[1]), string(m[2]))
+		if err == nil && len(stack) >= maxIncludeDepth {
+			err = fmt.Errorf("includes nested deeper than: %v", maxIncludeDepth)
+		}
+		for _, s := range stack {
+			if err == nil && s == target {
+				err = fmt.Errorf("include cycle: '%v'", strings.Join(append(stack, target), "' -> '"))
+			}
+		}
+		var content []byte
+		if err == nil {
+			// Depend on the target even if it's missing, so that the page is rebuilt once it exists
+			*included = append(*included, target)
+			content, err = os.ReadFile(target)
+		}
+		if err != nil {
+			ancli.Errf("failed to include: '%v' in: '%v', err: %v", m[2], origPath, err)
+			return fmt.Appendf(nil, "<!-- wd-41: failed to include: '%s', err: %v -->", m[2], err)
+		}
+		return fs.expand(target, content, append(stack, target), included)
+	})
+}
+
+// includeTarget resolves the path of an include directive, which must stay within
+// the served directory and not be ignored
+func (fs *Fileserver) includeTarget(origPath, kind, value string) (string, error) {
+	var target string
+	if kind == "virtual" {
+		target = filepath.Join(fs.masterPath, filepath.FromSlash(value))
+	} else {
+		target = filepath.Join(filepath.Dir(origPath), filepath.FromSlash(value))
+	}
+	rel, err := filepath.Rel(fs.masterPath, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%v' is outside of the served directory", value)
+	}
+	// Ignored files are neither watched nor served, so they may not be included either
+	if fs.isIgnored(target, false) {
+		return "", fmt.Errorf("'%v' is ignored", value)
+	}
+	return target, nil
+}
+
+// isHTML checks if the file is an html page, by extension or sniffed content type
+func isHTML(p string, b []byte) bool {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".html", ".htm", ".shtml":
+		return true
+	}
+	return strings.HasPrefix(http.DetectContentType(b), "text/html")
+}
+
+// latestModTime returns the latest modification time of the files, skipping missing ones
+func latestModTime(files []string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
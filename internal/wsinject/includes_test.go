@@ -0,0 +1,168 @@
+package wsinject
+
+import (
+	"context"
+	iofs "io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_expandIncludes(t *testing.T) {
+	setup := func(t *testing.T, files map[string]string) *Fileserver {
+		t.Helper()
+		root := t.TempDir()
+		for name, content := range files {
+			p := path.Join(root, name)
+			os.MkdirAll(path.Dir(p), 0o755)
+			os.WriteFile(p, []byte(content), 0o644)
+		}
+		fs := NewFileServer("/delta-streamer-ws", false)
+		fs.masterPath = root
+		return fs
+	}
+
+	for _, tc := range []struct {
+		desc  string
+		files map[string]string
+		page  string
+		want  string
+	}{
+		{
+			desc:  "it should include files relative to the page",
+			files: map[string]string{"blog/nav.html": "<nav></nav>"},
+			page:  `<body><!--#include file="nav.html" --></body>`,
+			want:  "<body><nav></nav></body>",
+		},
+		{
+			desc:  "it should include virtual paths relative to the root",
+			files: map[string]string{"partials/nav.html": "<nav></nav>"},
+			page:  `<body><!--#include virtual="/partials/nav.html" --></body>`,
+			want:  "<body><nav></nav></body>",
+		},
+		{
+			desc: "it should expand nested includes relative to the partial",
+			files: map[string]string{
+				"blog/partials/nav.html":   `<nav><!--#include file="links.html" --></nav>`,
+				"blog/partials/links.html": "<a></a>",
+			},
+			page: `<!--#include file="partials/nav.html" -->`,
+			want: "<nav><a></a></nav>",
+		},
+		{
+			desc:  "it should leave a comment on missing includes",
+			files: map[string]string{},
+			page:  `<!--#include file="missing.html" -->`,
+			want:  "<!-- wd-41: failed to include: 'missing.html'",
+		},
+		{
+			desc:  "it should refuse includes outside of the served directory",
+			files: map[string]string{},
+			page:  `<!--#include file="../../../etc/passwd" -->`,
+			want:  "is outside of the served directory -->",
+		},
+		{
+			desc:  "it should break include cycles",
+			files: map[string]string{"blog/a.html": `<!--#include file="b.html" -->`, "blog/b.html": `<!--#include file="a.html" -->`},
+			page:  `<!--#include file="a.html" -->`,
+			want:  "include cycle",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			fs := setup(t, tc.files)
+			got := fs.expandIncludes(path.Join(fs.masterPath, "blog", "index.html"), []byte(tc.page))
+			testboil.AssertStringContains(t, string(got), tc.want)
+		})
+	}
+
+	t.Run("it should not expand anything but html", func(t *testing.T) {
+		fs := setup(t, map[string]string{"nav.html": "<nav></nav>"})
+		src := `// <!--#include file="nav.html" -->`
+		got := fs.expandIncludes(path.Join(fs.masterPath, "main.js"), []byte(src))
+		testboil.FailTestIfDiff(t, string(got), src)
+	})
+
+	t.Run("it should refuse ignored includes", func(t *testing.T) {
+		fs := setup(t, map[string]string{".env": "SECRET=1"})
+		fs.ignore = &ignorer{}
+		fs.ignore.add(".env")
+		got := fs.expandIncludes(path.Join(fs.masterPath, "index.html"), []byte(`<!--#include virtual="/.env" -->`))
+		testboil.AssertStringContains(t, string(got), "'/.env' is ignored")
+	})
+
+	t.Run("it should make the page depend on every included file", func(t *testing.T) {
+		fs := setup(t, map[string]string{
+			"nav.html":   `<!--#include file="links.html" -->`,
+			"links.html": "<a></a>",
+		})
+		page := path.Join(fs.masterPath, "index.html")
+		fs.expandIncludes(page, []byte(`<!--#include file="nav.html" -->`))
+		testboil.FailTestIfDiff(t, strings.Join(fs.deps.of(path.Join(fs.masterPath, "links.html")), ","), page)
+	})
+}
+
+func Test_includes(t *testing.T) {
+	for _, mode := range []Mode{ModeMirror, ModeOverlay, ModeMiddleware} {
+		t.Run("it should rebuild and reload pages using a changed partial, in mode: "+string(mode), func(t *testing.T) {
+			root := t.TempDir()
+			os.MkdirAll(path.Join(root, "partials"), 0o755)
+			nav := path.Join(root, "partials", "nav.html")
+			os.WriteFile(nav, []byte("<nav>old</nav>"), 0o644)
+			os.WriteFile(path.Join(root, "index.html"), []byte(`<html><head></head><body><!--#include virtual="/partials/nav.html" --></body></html>`), 0o644)
+			// Served with this modification time, until the partial is edited
+			lastModified := time.Now().Add(-time.Hour).Truncate(time.Second)
+			os.Chtimes(path.Join(root, "index.html"), lastModified, lastModified)
+			os.Chtimes(nav, lastModified, lastModified)
+			fs := NewFileServer("/delta-streamer-ws", false, WithMode(mode), WithDebounce(0))
+			setupFileServer(t, fs, root)
+			refreshChan := make(chan message)
+			fs.registerWs("mock", refreshChan)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			t.Cleanup(cancel)
+			go fs.Start(ctx)
+			time.Sleep(time.Millisecond)
+
+			b := readServed(t, fs, "index.html")
+			testboil.AssertStringContains(t, b, "<nav>old</nav>")
+
+			os.WriteFile(nav, []byte("<nav>new</nav>"), 0o644)
+			for {
+				select {
+				case got := <-refreshChan:
+					if !slices.Contains(got.paths(), "/index.html") {
+						continue
+					}
+					b := readServed(t, fs, "index.html")
+					testboil.AssertStringContains(t, b, "<nav>new</nav>")
+
+					// Browsers revalidate the page on reload
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.Header.Set("If-Modified-Since", lastModified.UTC().Format(http.TimeFormat))
+					rec := httptest.NewRecorder()
+					http.FileServer(http.FS(fs.FS())).ServeHTTP(rec, req)
+					testboil.FailTestIfDiff(t, rec.Code, http.StatusOK)
+					testboil.AssertStringContains(t, rec.Body.String(), "<nav>new</nav>")
+					return
+				case <-ctx.Done():
+					t.Fatal("failed to receive reload of the page within time")
+				}
+			}
+		})
+	}
+}
+
+func readServed(t *testing.T, fs *Fileserver, name string) string {
+	t.Helper()
+	b, err := iofs.ReadFile(fs.FS(), name)
+	if err != nil {
+		t.Fatalf("failed to read served: '%v', err: %v", name, err)
+	}
+	return string(b)
+}
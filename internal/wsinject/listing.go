@@ -0,0 +1,207 @@
+package wsinject
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// listingEntry is a file or directory of a directory listing
+type listingEntry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	Type    string
+}
+
+// listingPage is the data which the directory listing is executed with
+type listingPage struct {
+	// Path of the directory, as requested by the browser
+	Path    string
+	Parent  bool
+	Entries []listingEntry
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"size": formatSize,
+	"href": entryHref,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="wd-41-listing" content="{{.Path}}">
+<title>Index of {{.Path}}</title>
+<style>
+body { max-width: 64rem; margin: 0 auto; padding: 2rem 1rem; font: 15px/1.5 system-ui, sans-serif; color: #222; }
+h1 { font-size: 1.3rem; font-weight: 500; word-break: break-all; }
+table { width: 100%; border-collapse: collapse; }
+th, td { padding: 0.35rem 0.6rem; text-align: left; border-bottom: 1px solid #eee; white-space: nowrap; }
+th { cursor: pointer; user-select: none; color: #555; font-weight: 500; }
+th[aria-sort=ascending]::after { content: " \25B2"; }
+th[aria-sort=descending]::after { content: " \25BC"; }
+td:first-child { width: 100%; white-space: normal; word-break: break-all; }
+td.size { text-align: right; font-variant-numeric: tabular-nums; }
+tr:hover td { background: #f7f7f7; }
+a { color: #0b57d0; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.dir a { font-weight: 500; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<thead>
+<tr><th data-key="name" aria-sort="ascending">Name</th><th data-key="size">Size</th><th data-key="mtime">Modified</th><th data-key="type">Type</th></tr>
+</thead>
+<tbody>
+{{- if .Parent}}
+<tr class="dir parent"><td><a href="../">../</a></td><td></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr{{if .IsDir}} class="dir"{{end}} data-name="{{.Name}}" data-size="{{.Size}}" data-mtime="{{.ModTime.Unix}}" data-type="{{.Type}}">
+<td><a href="{{href .}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td>
+<td class="size">{{if not .IsDir}}{{size .Size}}{{end}}</td>
+<td><time datetime="{{.ModTime.Format "2006-01-02T15:04:05Z07:00"}}">{{.ModTime.Format "2006-01-02 15:04"}}</time></td>
+<td>{{.Type}}</td>
+</tr>
+{{- end}}
+</tbody>
+</table>
+<script>
+// Sorts the entries by the clicked column, keeping directories first
+document.querySelectorAll('th[data-key]').forEach((th) => {
+  th.addEventListener('click', () => {
+    const key = th.dataset.key;
+    const order = th.getAttribute('aria-sort') === 'ascending' ? -1 : 1;
+    document.querySelectorAll('th[data-key]').forEach((other) => other.removeAttribute('aria-sort'));
+    th.setAttribute('aria-sort', order === 1 ? 'ascending' : 'descending');
+    const tbody = document.querySelector('tbody');
+    const rows = [...tbody.querySelectorAll('tr[data-name]')];
+    rows.sort((a, b) => {
+      const dirs = b.classList.contains('dir') - a.classList.contains('dir');
+      if (dirs !== 0) {
+        return dirs;
+      }
+      const x = a.dataset[key];
+      const y = b.dataset[key];
+      const cmp = key === 'size' || key === 'mtime' ? Number(x) - Number(y) : x.localeCompare(y, undefined, { numeric: true });
+      return cmp * order;
+    });
+    tbody.append(...rows);
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// listingSource returns the directory which should be listed for the request path, if
+// any. Directories are listed when they have no index page of their own.
+func (fs *Fileserver) listingSource(urlPath string) (string, bool) {
+	if !strings.HasSuffix(urlPath, "/") {
+		return "", false
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	origPath := filepath.Join(fs.masterPath, filepath.FromSlash(rel))
+	info, err := os.Stat(origPath)
+	if err != nil || !info.IsDir() || fs.isIgnored(origPath, true) {
+		return "", false
+	}
+	if fileExists(filepath.Join(origPath, "index.html")) {
+		return "", false
+	}
+	return origPath, true
+}
+
+// renderListing renders the directory listing of the directory at origPath
+func (fs *Fileserver) renderListing(origPath string) ([]byte, error) {
+	dirEntries, err := os.ReadDir(origPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	page := listingPage{Path: fs.urlPath(origPath)}
+	if page.Path != "/" {
+		page.Path += "/"
+		page.Parent = true
+	}
+	for _, d := range dirEntries {
+		entryPath := filepath.Join(origPath, d.Name())
+		if fs.isIgnored(entryPath, d.IsDir()) {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Removed since it was read
+			continue
+		}
+		entry := listingEntry{
+			Name:    d.Name(),
+			IsDir:   d.IsDir(),
+			ModTime: info.ModTime(),
+			Type:    "directory",
+		}
+		if !d.IsDir() {
+			entry.Size = info.Size()
+			entry.Type = fileType(d.Name())
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	slices.SortStableFunc(page.Entries, func(a, b listingEntry) int {
+		if a.IsDir != b.IsDir {
+			if a.IsDir {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	var b bytes.Buffer
+	err = listingTemplate.Execute(&b, page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute listing: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// entryHref returns the link to the entry, relative to the listed directory. The name
+// is escaped like http.FileServer does, so that names with '#', '?' or '%' resolve.
+func entryHref(e listingEntry) string {
+	name := e.Name
+	if e.IsDir {
+		name += "/"
+	}
+	return (&url.URL{Path: name}).String()
+}
+
+// fileType returns the media type of the file, by extension
+func fileType(name string) string {
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	if err != nil {
+		return "file"
+	}
+	return mediaType
+}
+
+// formatSize formats the size in bytes to be human readable
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
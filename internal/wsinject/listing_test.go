@@ -0,0 +1,126 @@
+package wsinject
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_listingSource(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(path.Join(root, "assets"), 0o755)
+	os.MkdirAll(path.Join(root, "site"), 0o755)
+	os.MkdirAll(path.Join(root, "node_modules"), 0o755)
+	os.WriteFile(path.Join(root, "site", "index.html"), []byte("<html></html>"), 0o644)
+	fs := NewFileServer("/delta-streamer-ws", false, WithIgnore("node_modules/"))
+	fs.masterPath = root
+	fs.setupIgnorer()
+
+	for _, tc := range []struct {
+		urlPath string
+		want    string
+	}{
+		{urlPath: "/", want: root},
+		{urlPath: "/assets/", want: path.Join(root, "assets")},
+		{urlPath: "/assets", want: ""},
+		{urlPath: "/site/", want: ""},
+		{urlPath: "/node_modules/", want: ""},
+		{urlPath: "/missing/", want: ""},
+	} {
+		t.Run(tc.urlPath, func(t *testing.T) {
+			got, _ := fs.listingSource(tc.urlPath)
+			testboil.FailTestIfDiff(t, got, tc.want)
+		})
+	}
+}
+
+func Test_renderListing(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(path.Join(root, "docs", "zz-dir"), 0o755)
+	os.WriteFile(path.Join(root, "docs", "a.css"), []byte("body {}"), 0o644)
+	os.WriteFile(path.Join(root, "docs", "big.bin"), make([]byte, 2048), 0o644)
+	os.WriteFile(path.Join(root, "docs", "secret.env"), []byte("SECRET=1"), 0o644)
+	os.WriteFile(path.Join(root, "docs", "#1 100%?.txt"), []byte("odd"), 0o644)
+	fs := NewFileServer("/delta-streamer-ws", false, WithIgnore("*.env"))
+	fs.masterPath = root
+	fs.setupIgnorer()
+
+	got, err := fs.renderListing(path.Join(root, "docs"))
+	if err != nil {
+		t.Fatalf("failed to render: %v", err)
+	}
+	page := string(got)
+	testboil.AssertStringContains(t, page, `<meta name="wd-41-listing" content="/docs/">`)
+	testboil.AssertStringContains(t, page, `<a href="../">../</a>`)
+	testboil.AssertStringContains(t, page, `data-size="2048"`)
+	testboil.AssertStringContains(t, page, "2.0 KiB")
+	testboil.AssertStringContains(t, page, "<td>text/css</td>")
+	testboil.AssertStringContains(t, page, `<a href="%231%20100%25%3F.txt">#1 100%?.txt</a>`)
+	if strings.Contains(page, "secret.env") {
+		t.Fatal("expected ignored files to not be listed")
+	}
+	if strings.Index(page, "zz-dir/") > strings.Index(page, "a.css") {
+		t.Fatal("expected directories to be listed first")
+	}
+}
+
+func TestRenderHandler_listing(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(path.Join(root, "a.txt"), []byte("a"), 0o644)
+	fs := NewFileServer("/delta-streamer-ws", false)
+	fs.masterPath = root
+	fs.setupIgnorer()
+	h := fs.RenderHandler(http.FileServer(http.Dir(root)))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	testboil.FailTestIfDiff(t, rec.Code, http.StatusOK)
+	b, _ := io.ReadAll(rec.Body)
+	testboil.AssertStringContains(t, string(b), "<title>Index of /</title>")
+	testboil.AssertStringContains(t, string(b), `<a href="a.txt">a.txt</a>`)
+	testboil.AssertStringContains(t, string(b), ClientScriptPath)
+	if strings.Contains(string(b), `href="../"`) {
+		t.Fatal("expected no parent link at the root")
+	}
+}
+
+func Test_entryHref(t *testing.T) {
+	for _, tc := range []struct {
+		entry listingEntry
+		want  string
+	}{
+		{entry: listingEntry{Name: "a.txt"}, want: "a.txt"},
+		{entry: listingEntry{Name: "docs", IsDir: true}, want: "docs/"},
+		{entry: listingEntry{Name: "#1.txt"}, want: "%231.txt"},
+		{entry: listingEntry{Name: "what?.txt"}, want: "what%3F.txt"},
+		{entry: listingEntry{Name: "100%.txt"}, want: "100%25.txt"},
+		{entry: listingEntry{Name: "a b.txt"}, want: "a%20b.txt"},
+		{entry: listingEntry{Name: "c:d.txt"}, want: "./c:d.txt"},
+	} {
+		t.Run(tc.entry.Name, func(t *testing.T) {
+			testboil.FailTestIfDiff(t, entryHref(tc.entry), tc.want)
+		})
+	}
+}
+
+func Test_formatSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		want string
+	}{
+		{size: 0, want: "0 B"},
+		{size: 1023, want: "1023 B"},
+		{size: 1536, want: "1.5 KiB"},
+		{size: 5 * 1024 * 1024, want: "5.0 MiB"},
+	} {
+		t.Run(tc.want, func(t *testing.T) {
+			testboil.FailTestIfDiff(t, formatSize(tc.size), tc.want)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package wsinject
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+)
+
+const markdownExt = ".md"
+
+// markdownPage is the data which markdown layouts are executed with
+type markdownPage struct {
+	// Title is the first level one heading, or the file name if there is none
+	Title string
+	// Content is the rendered markdown
+	Content template.HTML
+	// Path of the markdown file, relative to the served directory
+	Path string
+}
+
+var defaultMarkdownLayout = template.Must(template.New("layout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 48rem; margin: 0 auto; padding: 2rem 1rem; font: 16px/1.6 system-ui, sans-serif; color: #222; }
+pre, code { font-family: ui-monospace, monospace; background: #f4f4f4; border-radius: 4px; }
+pre { padding: 1rem; overflow: auto; }
+code { padding: 0.1rem 0.3rem; }
+pre code { padding: 0; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: 0.3rem 0.6rem; }
+blockquote { margin-left: 0; padding-left: 1rem; border-left: 4px solid #ddd; color: #555; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+{{.Content}}
+</body>
+</html>
+`))
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	// The markdown is the developer's own, raw html within it is intended
+	goldmark.WithRendererOptions(gmhtml.WithUnsafe()),
+)
+
+// setupMarkdownLayout checks that the markdown layout, if set, may be parsed
+func (fs *Fileserver) setupMarkdownLayout() error {
+	if fs.markdownLayout == "" {
+		return nil
+	}
+	// Cleaned to match the paths of the file events
+	fs.markdownLayout = filepath.Clean(fs.markdownLayout)
+	_, err := template.ParseFiles(fs.markdownLayout)
+	return err
+}
+
+// markdownSource returns the markdown file which should be rendered for the request
+// path, if any. Markdown is rendered when requested directly, or when the html page,
+// or directory index, is requested and only the markdown exists.
+func (fs *Fileserver) markdownSource(urlPath string) (string, bool) {
+	rel := fs.requestedPage(urlPath)
+	var candidate string
+	switch path.Ext(rel) {
+	case markdownExt:
+		candidate = rel
+	case ".html":
+		if fileExists(filepath.Join(fs.masterPath, filepath.FromSlash(rel))) {
+			return "", false
+		}
+		candidate = strings.TrimSuffix(rel, ".html") + markdownExt
+	default:
+		return "", false
+	}
+	origPath := filepath.Join(fs.masterPath, filepath.FromSlash(candidate))
+	if !fileExists(origPath) || fs.isIgnored(origPath, false) {
+		return "", false
+	}
+	return origPath, true
+}
+
+// renderMarkdown renders the markdown file at origPath into an html page, using the
+// markdown layout if one is set
+func (fs *Fileserver) renderMarkdown(origPath string) ([]byte, error) {
+	src, err := os.ReadFile(origPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read markdown: %w", err)
+	}
+	layout := defaultMarkdownLayout
+	if fs.markdownLayout != "" {
+		// Parsed on every render, so that changes apply on reload
+		layout, err = template.ParseFiles(fs.markdownLayout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse markdown layout: %w", err)
+		}
+		fs.deps.set(origPath, fs.markdownLayout)
+	}
+	doc := markdown.Parser().Parse(text.NewReader(src))
+	var content bytes.Buffer
+	err = markdown.Renderer().Render(&content, src, doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render markdown: %w", err)
+	}
+	title := markdownTitle(doc, src)
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(origPath), markdownExt)
+	}
+	var page bytes.Buffer
+	err = layout.Execute(&page, markdownPage{
+		Title:   title,
+		Content: template.HTML(content.String()),
+		Path:    fs.relPath(origPath),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute markdown layout: %w", err)
+	}
+	return page.Bytes(), nil
+}
+
+// markdownTitle returns the text of the first level one heading of the document
+func markdownTitle(doc ast.Node, src []byte) string {
+	var title strings.Builder
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		h, ok := n.(*ast.Heading)
+		if !ok || h.Level != 1 {
+			return ast.WalkContinue, nil
+		}
+		ast.Walk(h, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+			if t, ok := n.(*ast.Text); ok && entering {
+				title.Write(t.Segment.Value(src))
+			}
+			return ast.WalkContinue, nil
+		})
+		return ast.WalkStop, nil
+	})
+	return title.String()
+}
+
+func fileExists(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,83 @@
+package wsinject
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_renderMarkdown(t *testing.T) {
+	t.Run("it should render into the default layout, titled by the first heading", func(t *testing.T) {
+		root := t.TempDir()
+		src := path.Join(root, "notes.md")
+		os.WriteFile(src, []byte("Intro\n\n# The *notes*\n\n| a | b |\n|---|---|\n| 1 | 2 |\n"), 0o644)
+		fs := NewFileServer("/delta-streamer-ws", false)
+		fs.masterPath = root
+		got, err := fs.renderMarkdown(src)
+		if err != nil {
+			t.Fatalf("failed to render: %v", err)
+		}
+		testboil.AssertStringContains(t, string(got), "<title>The notes</title>")
+		testboil.AssertStringContains(t, string(got), `<h1 id="the-notes">The <em>notes</em></h1>`)
+		testboil.AssertStringContains(t, string(got), "<table>")
+	})
+
+	t.Run("it should render into the layout, and depend on it", func(t *testing.T) {
+		root := t.TempDir()
+		src := path.Join(root, "notes.md")
+		layout := path.Join(root, "_layout.html")
+		os.WriteFile(src, []byte("no heading"), 0o644)
+		os.WriteFile(layout, []byte(`<html><head><title>{{.Title}} - {{.Path}}</title></head><body>{{.Content}}</body></html>`), 0o644)
+		fs := NewFileServer("/delta-streamer-ws", false, WithMarkdownLayout(layout))
+		fs.masterPath = root
+		err := fs.setupMarkdownLayout()
+		if err != nil {
+			t.Fatalf("failed to setup layout: %v", err)
+		}
+		got, err := fs.renderMarkdown(src)
+		if err != nil {
+			t.Fatalf("failed to render: %v", err)
+		}
+		testboil.FailTestIfDiff(t, string(got), "<html><head><title>notes - notes.md</title></head><body><p>no heading</p>\n</body></html>")
+		testboil.FailTestIfDiff(t, strings.Join(fs.deps.of(layout), ","), src)
+	})
+
+	t.Run("it should fail setup on broken layouts", func(t *testing.T) {
+		layout := path.Join(t.TempDir(), "_layout.html")
+		os.WriteFile(layout, []byte(`{{.Title`), 0o644)
+		fs := NewFileServer("/delta-streamer-ws", false, WithMarkdownLayout(layout))
+		if fs.setupMarkdownLayout() == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestRenderHandler(t *testing.T) {
+	fs, root := renderFixture(t, map[string]string{"notes.md": "# Notes", "plain.txt": "plain"})
+	h := fs.RenderHandler(http.FileServer(http.Dir(root)))
+
+	for _, p := range []string{"/notes.md", "/notes.html"} {
+		t.Run("it should serve injected markdown on: "+p, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+			testboil.FailTestIfDiff(t, rec.Code, http.StatusOK)
+			testboil.FailTestIfDiff(t, rec.Header().Get("Content-Type"), "text/html; charset=utf-8")
+			b, _ := io.ReadAll(rec.Body)
+			testboil.AssertStringContains(t, string(b), `<h1 id="notes">Notes</h1>`)
+			testboil.AssertStringContains(t, string(b), ClientScriptPath)
+		})
+	}
+
+	t.Run("it should pass on anything else", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/plain.txt", nil))
+		b, _ := io.ReadAll(rec.Body)
+		testboil.FailTestIfDiff(t, string(b), "plain")
+	})
+}
@@ -0,0 +1,297 @@
+package wsinject
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+)
+
+// InjectHandler injects the delta-streamer script into every text/html response of
+// next, as it's being served. This allows injection into responses which never touch
+// the filesystem, such as generated or proxied pages.
+func (fs *Fileserver) InjectHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withSupportedEncodings(r)
+		iw := &injectingResponseWriter{
+			ResponseWriter: w,
+			scriptTag:      deltaStreamer,
+			rules:          fs.injectRules,
+			path:           r.URL.Path,
+			headOnly:       r.Method == http.MethodHead,
+		}
+		next.ServeHTTP(iw, r)
+		err := iw.finish()
+		if err != nil {
+			ancli.Errf("failed to inject delta-streamer script into: '%v', err: %v", r.URL.Path, err)
+		}
+	})
+}
+
+// withSupportedEncodings restricts the encodings accepted by the client to the ones
+// which may be decoded for injection, so that upstream handlers don't compress with
+// anything else
+func withSupportedEncodings(r *http.Request) *http.Request {
+	accepted := r.Header.Get("Accept-Encoding")
+	if accepted == "" {
+		return r
+	}
+	r = r.Clone(r.Context())
+	if acceptsGzip(accepted) {
+		r.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		r.Header.Del("Accept-Encoding")
+	}
+	return r
+}
+
+// acceptsGzip checks if the Accept-Encoding header value accepts gzip, by name or by
+// wildcard, with a non-zero quality
+func acceptsGzip(accepted string) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, part := range strings.Split(accepted, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, val, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || !strings.EqualFold(key, "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil {
+				// Malformed qualities are treated as refusals
+				parsed = 0
+			}
+			q = parsed
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			wildcardQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
+
+type injectState int
+
+const (
+	// undecided until headers, and possibly the first bytes, have been seen
+	undecided injectState = iota
+	// passthrough writes straight to the underlying ResponseWriter
+	passthrough
+	// buffering html until the injection point is found, or the response is finished
+	buffering
+)
+
+type injectingResponseWriter struct {
+	http.ResponseWriter
+	scriptTag string
+	rules     *injectRules
+	path      string
+	// headOnly responses have no body to inject into
+	headOnly bool
+
+	state  injectState
+	status int
+	gzip   bool
+	buf    bytes.Buffer
+	// scanned is how much of buf has been searched for the closing head tag
+	scanned int
+}
+
+// closingHead is searched for in buffered html, before tokenizing it to find the
+// injection point
+var closingHead = []byte("</head")
+
+func (iw *injectingResponseWriter) WriteHeader(status int) {
+	if iw.state != undecided || status < http.StatusOK {
+		iw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	iw.status = status
+	if iw.Header().Get("Content-Type") == "" {
+		// Decided by sniffing the first write
+		return
+	}
+	iw.decide()
+}
+
+func (iw *injectingResponseWriter) Write(b []byte) (int, error) {
+	if iw.state == undecided {
+		if iw.status == 0 {
+			iw.status = http.StatusOK
+		}
+		if iw.Header().Get("Content-Type") == "" {
+			iw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		iw.decide()
+	}
+	if iw.state == passthrough {
+		return iw.ResponseWriter.Write(b)
+	}
+	iw.buf.Write(b)
+	if iw.gzip {
+		// Compressed content can only be injected once complete
+		return len(b), nil
+	}
+	if !iw.headClosed() {
+		// Until the head is closed, the fallback strategies are only known once the
+		// complete document has been seen
+		return len(b), nil
+	}
+	injected, strategy := injectScript(iw.buf.Bytes(), iw.scriptTag)
+	if strategy != injectHead {
+		// The closing tag was within a comment or script, or such
+		return len(b), nil
+	}
+	if optedOut(iw.buf.Bytes()) {
+		injected = iw.buf.Bytes()
+	} else {
+		ancli.PrintfNotice("injected delta-streamer script loading tag into response, using strategy: '%v'", strategy)
+	}
+	// Found the injection point, the rest of the response may be streamed
+	iw.buf.Reset()
+	iw.state = passthrough
+	iw.ResponseWriter.WriteHeader(iw.status)
+	_, err := iw.ResponseWriter.Write(injected)
+	return len(b), err
+}
+
+// headClosed checks if a closing head tag has been written since the last check. Only
+// the new bytes are searched, along with the tail of the previous ones in case the
+// tag has been split between writes, so that buffering stays linear.
+func (iw *injectingResponseWriter) headClosed() bool {
+	buf := iw.buf.Bytes()
+	start := max(iw.scanned-len(closingHead)+1, 0)
+	iw.scanned = len(buf)
+	return bytes.Contains(bytes.ToLower(buf[start:]), closingHead)
+}
+
+// decide if the response should be injected, and write the headers if not
+func (iw *injectingResponseWriter) decide() {
+	h := iw.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	encoding := h.Get("Content-Encoding")
+	injectable := !iw.headOnly &&
+		mediaType == "text/html" &&
+		iw.rules.match(iw.path, h.Get("Content-Type")) &&
+		// Partial and empty responses can't be injected
+		iw.status != http.StatusPartialContent &&
+		iw.status != http.StatusNoContent &&
+		iw.status != http.StatusNotModified &&
+		(encoding == "" || encoding == "identity" || encoding == "gzip")
+	if !injectable {
+		iw.state = passthrough
+		iw.ResponseWriter.WriteHeader(iw.status)
+		return
+	}
+	iw.state = buffering
+	iw.gzip = encoding == "gzip"
+	// The length changes once injected
+	h.Del("Content-Length")
+	h.Del("ETag")
+}
+
+// finish the response by writing whatever is still buffered, injecting it
+// if the injection point hasn't been found
+func (iw *injectingResponseWriter) finish() error {
+	switch iw.state {
+	case undecided:
+		if iw.status != 0 {
+			iw.ResponseWriter.WriteHeader(iw.status)
+		}
+		return nil
+	case passthrough:
+		return nil
+	}
+	b := iw.buf.Bytes()
+	if iw.gzip {
+		var err error
+		b, err = gunzip(b)
+		if err != nil {
+			// Write it as-is rather than breaking the response
+			iw.writeBuffered(iw.buf.Bytes())
+			return fmt.Errorf("failed to decompress: %w", err)
+		}
+	}
+	if optedOut(b) {
+		iw.writeBuffered(iw.buf.Bytes())
+		return nil
+	}
+	injected, strategy := injectScript(b, iw.scriptTag)
+	ancli.PrintfNotice("injected delta-streamer script loading tag into response, using strategy: '%v'", strategy)
+	if iw.gzip {
+		var err error
+		injected, err = gzipBytes(injected)
+		if err != nil {
+			iw.writeBuffered(iw.buf.Bytes())
+			return fmt.Errorf("failed to compress: %w", err)
+		}
+	}
+	iw.writeBuffered(injected)
+	return nil
+}
+
+func (iw *injectingResponseWriter) writeBuffered(b []byte) {
+	iw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	iw.ResponseWriter.WriteHeader(iw.status)
+	iw.ResponseWriter.Write(b)
+}
+
+// Flush passes through, unless the html is still being buffered
+func (iw *injectingResponseWriter) Flush() {
+	if iw.state == buffering {
+		return
+	}
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack the underlying connection, used on websocket upgrades
+func (iw *injectingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := iw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying response writer can't be hijacked")
+	}
+	return h.Hijack()
+}
+
+func (iw *injectingResponseWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
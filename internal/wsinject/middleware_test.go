@@ -0,0 +1,217 @@
+package wsinject
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_InjectHandler(t *testing.T) {
+	serve := func(t *testing.T, h http.HandlerFunc, req *http.Request) *http.Response {
+		t.Helper()
+		fs := NewFileServer("/delta-streamer-ws.js", false)
+		rec := httptest.NewRecorder()
+		fs.InjectHandler(h).ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	readBody := func(t *testing.T, resp *http.Response) string {
+		t.Helper()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		return string(b)
+	}
+
+	t.Run("it should inject into html responses and fix the content length", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(mockHtml)))
+			w.Write([]byte(mockHtml))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		got := readBody(t, resp)
+		testboil.AssertStringContains(t, got, deltaStreamer)
+		if resp.Header.Get("Content-Length") != "" && resp.Header.Get("Content-Length") != strconv.Itoa(len(got)) {
+			t.Fatalf("expected content length: %v, got: %v", len(got), resp.Header.Get("Content-Length"))
+		}
+	})
+
+	t.Run("it should inject into responses sniffed as html", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(mockHtml))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.AssertStringContains(t, readBody(t, resp), deltaStreamer)
+	})
+
+	t.Run("it should inject into html written in chunks", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			for _, chunk := range strings.SplitAfter(mockHtml, "\n") {
+				w.Write([]byte(chunk))
+				w.(http.Flusher).Flush()
+			}
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		got := readBody(t, resp)
+		testboil.FailTestIfDiff(t, strings.Count(got, deltaStreamer), 1)
+		testboil.AssertStringContains(t, got, "</html>")
+	})
+
+	t.Run("it should inject when the closing head tag is split between writes", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><head><title>t</title></HE"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("AD><body>streamed</body></html>"))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.FailTestIfDiff(t, readBody(t, resp), "<html><head><title>t</title>"+deltaStreamer+"</HEAD><body>streamed</body></html>")
+	})
+
+	t.Run("it should not inject at closing head tags within comments", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><head><!-- </head> -->"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("<title>t</title></head><body></body></html>"))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.FailTestIfDiff(t, readBody(t, resp), "<html><head><!-- </head> --><title>t</title>"+deltaStreamer+"</head><body></body></html>")
+	})
+
+	t.Run("it should inject into documents without head once complete", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<p>first</p>"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("<p>second</p></body>"))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.FailTestIfDiff(t, readBody(t, resp), "<p>first</p><p>second</p>"+deltaStreamer+"</body>")
+	})
+
+	t.Run("it should only opt out on markers within the head, like the other modes", func(t *testing.T) {
+		streamed := func(page string) string {
+			resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				head, body, _ := strings.Cut(page, "<body>")
+				w.Write([]byte(head))
+				w.(http.Flusher).Flush()
+				w.Write([]byte("<body>" + body))
+			}, httptest.NewRequest(http.MethodGet, "/", nil))
+			return readBody(t, resp)
+		}
+		inHead := "<html><head><!-- wd-41:no-inject --></head><body></body></html>"
+		testboil.FailTestIfDiff(t, streamed(inHead), inHead)
+		inBody := "<html><head></head><body><!-- wd-41:no-inject --></body></html>"
+		testboil.AssertStringContains(t, streamed(inBody), deltaStreamer)
+	})
+
+	t.Run("it should pass through other content types", func(t *testing.T) {
+		want := "body { color: red; }"
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/css")
+			w.Write([]byte(want))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.FailTestIfDiff(t, readBody(t, resp), want)
+	})
+
+	t.Run("it should pass through partial content", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(mockHtml[:20]))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.FailTestIfDiff(t, resp.StatusCode, http.StatusPartialContent)
+		testboil.FailTestIfDiff(t, readBody(t, resp), mockHtml[:20])
+	})
+
+	t.Run("it should keep the status code", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(mockHtml))
+		}, httptest.NewRequest(http.MethodGet, "/", nil))
+		testboil.FailTestIfDiff(t, resp.StatusCode, http.StatusNotFound)
+		testboil.AssertStringContains(t, readBody(t, resp), deltaStreamer)
+	})
+
+	t.Run("it should inject into gzipped html", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "br, gzip")
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			testboil.FailTestIfDiff(t, r.Header.Get("Accept-Encoding"), "gzip")
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			gw.Write([]byte(mockHtml))
+			gw.Close()
+		}, req)
+		testboil.FailTestIfDiff(t, resp.Header.Get("Content-Encoding"), "gzip")
+		b, err := gunzip([]byte(readBody(t, resp)))
+		if err != nil {
+			t.Fatalf("failed to gunzip response: %v", err)
+		}
+		testboil.AssertStringContains(t, string(b), deltaStreamer)
+	})
+
+	t.Run("it should not alter head requests", func(t *testing.T) {
+		resp := serve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Length", "1337")
+		}, httptest.NewRequest(http.MethodHead, "/", nil))
+		testboil.FailTestIfDiff(t, resp.Header.Get("Content-Length"), "1337")
+	})
+
+	t.Run("it should work with http.FileServer", func(t *testing.T) {
+		fs := NewFileServer("/delta-streamer-ws.js", false)
+		dir := t.TempDir()
+		os.WriteFile(path.Join(dir, "index.html"), []byte(mockHtml), 0o644)
+		server := httptest.NewServer(fs.InjectHandler(http.FileServer(http.Dir(dir))))
+		t.Cleanup(server.Close)
+		resp, err := http.Get(server.URL + "/index.html")
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		defer resp.Body.Close()
+		got := readBody(t, resp)
+		testboil.AssertStringContains(t, got, deltaStreamer)
+		if !strings.HasSuffix(got, "</html>") {
+			t.Fatalf("expected complete html document, got: %v", got)
+		}
+	})
+}
+
+func Test_withSupportedEncodings(t *testing.T) {
+	for _, tc := range []struct {
+		given string
+		want  string
+	}{
+		{given: "", want: ""},
+		{given: "gzip", want: "gzip"},
+		{given: "br, gzip", want: "gzip"},
+		{given: "gzip;q=0.5, br", want: "gzip"},
+		{given: "GZIP", want: "gzip"},
+		{given: "br", want: ""},
+		{given: "gzip;q=0", want: ""},
+		{given: "gzip; q=0.0, br", want: ""},
+		{given: "*", want: "gzip"},
+		{given: "*;q=0", want: ""},
+		{given: "gzip;q=0, *", want: ""},
+		{given: "gzip, *;q=0", want: "gzip"},
+		{given: "gzip;q=nope", want: ""},
+	} {
+		t.Run(tc.given, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.given != "" {
+				req.Header.Set("Accept-Encoding", tc.given)
+			}
+			testboil.FailTestIfDiff(t, withSupportedEncodings(req).Header.Get("Accept-Encoding"), tc.want)
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package wsinject
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+)
+
+const (
+	// tmpMirrorPrefix of temporary mirrors, followed by the pid of the process which owns it
+	tmpMirrorPrefix = "wd-41_"
+	// pinnedMirrorMarker marks a directory as a mirror, so that a pinned mirror directory
+	// is never pruned unless it has been created by wd-41
+	pinnedMirrorMarker = ".wd41-mirror"
+	// legacyMirrorMaxAge is the age at which temporary mirrors without a pid are considered stale
+	legacyMirrorMaxAge = 24 * time.Hour
+)
+
+// setupMirrorDir creates a temporary mirror owned by this process, or prepares the
+// pinned mirror directory for reuse
+func (fs *Fileserver) setupMirrorDir() error {
+	if fs.mirrorDir == "" {
+		dir, err := os.MkdirTemp(fs.tmpDir, fmt.Sprintf("%v%v_*", tmpMirrorPrefix, os.Getpid()))
+		if err != nil {
+			return fmt.Errorf("failed to create temporary mirror dir: %w", err)
+		}
+		fs.mirrorPath = dir
+		return nil
+	}
+
+	master, err := filepath.Abs(fs.masterPath)
+	if err != nil {
+		return fmt.Errorf("failed to find absolute master path: %w", err)
+	}
+	mirror, err := filepath.Abs(fs.mirrorDir)
+	if err != nil {
+		return fmt.Errorf("failed to find absolute mirror path: %w", err)
+	}
+	if mirror == master || strings.HasPrefix(mirror, master+string(filepath.Separator)) {
+		return fmt.Errorf("mirror dir: '%v' may not be within the served directory: '%v'", mirror, master)
+	}
+	entries, err := os.ReadDir(mirror)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read mirror dir: %w", err)
+	}
+	if len(entries) > 0 {
+		if _, err := os.Stat(filepath.Join(mirror, pinnedMirrorMarker)); err != nil {
+			return fmt.Errorf("refusing to reuse non-empty dir: '%v' as mirror, as it hasn't been created by wd-41", mirror)
+		}
+	}
+	err = os.MkdirAll(mirror, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create mirror dir: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(mirror, pinnedMirrorMarker), nil, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to mark mirror dir: %w", err)
+	}
+	fs.mirrorPath = mirror
+	return nil
+}
+
+// pruneMirror removes everything in a reused mirror which no longer exists in master,
+// or is now ignored
+func (fs *Fileserver) pruneMirror() error {
+	return filepath.WalkDir(fs.mirrorPath, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fs.mirrorPath, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." || rel == pinnedMirrorMarker {
+			return nil
+		}
+		origPath := filepath.Join(fs.masterPath, rel)
+		info, err := os.Stat(origPath)
+		if err == nil && info.IsDir() == d.IsDir() && !fs.isIgnored(origPath, d.IsDir()) {
+			return nil
+		}
+		ancli.PrintfNotice("pruning stale mirrored path: '%v'", p)
+		err = os.RemoveAll(p)
+		if err != nil {
+			return fmt.Errorf("failed to prune: '%v', err: %w", p, err)
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// removeStaleMirrors removes the temporary mirrors within tmpDir which have been left
+// behind by processes which are no longer running
+func removeStaleMirrors(tmpDir string) {
+	candidates, err := filepath.Glob(filepath.Join(tmpDir, tmpMirrorPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, candidate := range candidates {
+		if !isStaleMirror(candidate) {
+			continue
+		}
+		ancli.PrintfNotice("removing stale mirror: '%v'", candidate)
+		err := os.RemoveAll(candidate)
+		if err != nil {
+			ancli.Errf("failed to remove stale mirror: '%v', err: %v", candidate, err)
+		}
+	}
+}
+
+func isStaleMirror(dir string) bool {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(filepath.Base(dir), tmpMirrorPrefix), "_")
+	if len(parts) != 2 {
+		// Created before mirrors were owned by a pid, there's no telling if it's in use
+		return time.Since(info.ModTime()) > legacyMirrorMaxAge
+	}
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	return pid != os.Getpid() && !processAlive(pid)
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess opens a handle to the process, so it's only found if it exists
+		p.Release()
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Close stops watching for changes and removes the mirror, unless it's been pinned
+// for reuse across runs
+func (fs *Fileserver) Close() error {
+	var errs []error
+	if fs.watcher != nil {
+		errs = append(errs, fs.watcher.Close())
+	}
+	if fs.mirrorPath != "" && fs.mirrorDir == "" {
+		ancli.PrintfNotice("removing mirror: '%v'", fs.mirrorPath)
+		errs = append(errs, os.RemoveAll(fs.mirrorPath))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,133 @@
+package wsinject
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_mirrorDir(t *testing.T) {
+	setupMaster := func(t *testing.T) string {
+		t.Helper()
+		master := t.TempDir()
+		os.WriteFile(path.Join(master, "index.html"), []byte(mockHtml), 0o644)
+		return master
+	}
+
+	t.Run("it should remove temporary mirror on close", func(t *testing.T) {
+		fs := NewFileServer("/delta-streamer-ws.js", false)
+		fs.tmpDir = t.TempDir()
+		mirrorPath, err := fs.Setup(setupMaster(t))
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+		err = fs.Close()
+		if err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+		_, err = os.Stat(mirrorPath)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected mirror to be removed, got err: %v", err)
+		}
+	})
+
+	t.Run("it should reuse and prune pinned mirror dir", func(t *testing.T) {
+		master := setupMaster(t)
+		pinned := path.Join(t.TempDir(), "mirror")
+		fs := NewFileServer("/delta-streamer-ws.js", false, WithMirrorDir(pinned))
+		fs.tmpDir = t.TempDir()
+		mirrorPath, err := fs.Setup(master)
+		if err != nil {
+			t.Fatalf("failed to setup: %v", err)
+		}
+		if mirrorPath != pinned {
+			t.Fatalf("expected mirror path: '%v', got: '%v'", pinned, mirrorPath)
+		}
+		fs.Close()
+		if _, err := os.Stat(path.Join(pinned, "index.html")); err != nil {
+			t.Fatalf("expected pinned mirror to remain after close, got err: %v", err)
+		}
+
+		os.Remove(path.Join(master, "index.html"))
+		os.WriteFile(path.Join(master, "other.html"), []byte(mockHtml), 0o644)
+		fs = NewFileServer("/delta-streamer-ws.js", false, WithMirrorDir(pinned))
+		setupFileServer(t, fs, master)
+		if _, err := os.Stat(path.Join(pinned, "index.html")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected stale file to be pruned, got err: %v", err)
+		}
+		if _, err := os.Stat(path.Join(pinned, "other.html")); err != nil {
+			t.Fatalf("expected new file to be mirrored, got err: %v", err)
+		}
+	})
+
+	t.Run("it should refuse to reuse dirs not created by wd-41", func(t *testing.T) {
+		notMirror := t.TempDir()
+		os.WriteFile(path.Join(notMirror, "precious.txt"), []byte("precious"), 0o644)
+		fs := NewFileServer("/delta-streamer-ws.js", false, WithMirrorDir(notMirror))
+		fs.tmpDir = t.TempDir()
+		t.Cleanup(func() { fs.Close() })
+		_, err := fs.Setup(setupMaster(t))
+		if err == nil {
+			t.Fatal("expected error when reusing unmarked dir")
+		}
+		if _, err := os.Stat(path.Join(notMirror, "precious.txt")); err != nil {
+			t.Fatalf("expected unrelated file to be untouched, got err: %v", err)
+		}
+	})
+
+	t.Run("it should refuse mirror dirs within master", func(t *testing.T) {
+		master := setupMaster(t)
+		fs := NewFileServer("/delta-streamer-ws.js", false, WithMirrorDir(path.Join(master, "mirror")))
+		fs.tmpDir = t.TempDir()
+		t.Cleanup(func() { fs.Close() })
+		_, err := fs.Setup(master)
+		if err == nil {
+			t.Fatal("expected error when mirror is within master")
+		}
+	})
+}
+
+func Test_removeStaleMirrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	deadProcess := exec.Command(os.Args[0], "-test.run=^$")
+	err := deadProcess.Run()
+	if err != nil {
+		t.Fatalf("failed to run short lived process: %v", err)
+	}
+	mkdir := func(t *testing.T, name string) string {
+		t.Helper()
+		p := path.Join(tmpDir, name)
+		err := os.Mkdir(p, 0o755)
+		if err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		return p
+	}
+	dead := mkdir(t, fmt.Sprintf("%v%v_123", tmpMirrorPrefix, deadProcess.Process.Pid))
+	alive := mkdir(t, fmt.Sprintf("%v%v_123", tmpMirrorPrefix, os.Getpid()))
+	legacyOld := mkdir(t, tmpMirrorPrefix+"111")
+	old := time.Now().Add(-2 * legacyMirrorMaxAge)
+	os.Chtimes(legacyOld, old, old)
+	legacyNew := mkdir(t, tmpMirrorPrefix+"222")
+	unrelated := mkdir(t, "unrelated_1_2")
+
+	removeStaleMirrors(tmpDir)
+
+	for p, wantRemoved := range map[string]bool{
+		dead:      true,
+		alive:     false,
+		legacyOld: true,
+		legacyNew: false,
+		unrelated: false,
+	} {
+		_, err := os.Stat(p)
+		gotRemoved := errors.Is(err, os.ErrNotExist)
+		if gotRemoved != wantRemoved {
+			t.Errorf("path: '%v', expected removed: %v, got removed: %v", p, wantRemoved, gotRemoved)
+		}
+	}
+}
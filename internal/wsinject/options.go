@@ -0,0 +1,129 @@
+package wsinject
+
+import (
+	"path"
+	"time"
+)
+
+// Mode decides how the injected content is served
+type Mode string
+
+const (
+	// ModeMirror copies master to a mirror directory, injecting html pages as they're copied
+	ModeMirror Mode = "mirror"
+	// ModeOverlay serves master directly, keeping only the injected html pages in memory
+	ModeOverlay Mode = "overlay"
+	// ModeMiddleware serves master directly, leaving the injection to InjectHandler
+	ModeMiddleware Mode = "middleware"
+)
+
+// Option configures optional behaviour of the Fileserver
+type Option func(*Fileserver)
+
+// WithDebounce sets the settle window which file events are gathered within
+// before the mirror is updated and a single batch of changes is sent to the
+// browsers. A window of 0 handles every event as soon as it arrives.
+func WithDebounce(window time.Duration) Option {
+	return func(fs *Fileserver) {
+		fs.debounce = window
+	}
+}
+
+// WithIgnore adds gitignore-styled glob patterns of paths, relative to the served
+// directory, to exclude from the mirror and watcher
+func WithIgnore(patterns ...string) Option {
+	return func(fs *Fileserver) {
+		fs.ignorePatterns = append(fs.ignorePatterns, patterns...)
+	}
+}
+
+// WithGitignore sets if the .gitignore at the root of the served directory
+// should be respected. It is by default.
+func WithGitignore(respect bool) Option {
+	return func(fs *Fileserver) {
+		fs.respectGitignore = respect
+	}
+}
+
+// WithPollWatcher detects changes by polling the served directory each interval
+// instead of using fsnotify. If hash is set, files are compared by content instead
+// of by modification time and size.
+func WithPollWatcher(interval time.Duration, hash bool) Option {
+	return func(fs *Fileserver) {
+		fs.poll = true
+		fs.pollInterval = interval
+		fs.pollHash = hash
+	}
+}
+
+// WithMode sets how the injected content is served, ModeMirror by default
+func WithMode(m Mode) Option {
+	return func(fs *Fileserver) {
+		fs.mode = m
+	}
+}
+
+// WithMirrorDir pins the mirror to dir, which is reused across runs instead of
+// creating, and removing, a temporary mirror
+func WithMirrorDir(dir string) Option {
+	return func(fs *Fileserver) {
+		fs.mirrorDir = dir
+	}
+}
+
+// WithInjectRules sets which files get the delta-streamer script injected, in addition
+// to the defaults. Patterns starting with '.' match extensions, patterns starting with
+// 'type:' match the sniffed content type and any other pattern is a gitignore-styled glob.
+// Excludes take precedence over includes.
+func WithInjectRules(includes, excludes []string) Option {
+	return func(fs *Fileserver) {
+		fs.injectRules = newInjectRules(includes, excludes)
+	}
+}
+
+// WithPublicURL sets the URL which browsers reach wd-41 on, such as when proxied. By
+// default, the browsers connect back to the host which served the page.
+func WithPublicURL(publicURL string) Option {
+	return func(fs *Fileserver) {
+		fs.publicURL = publicURL
+	}
+}
+
+// WithConsoleForwarding makes the browsers send their console output, uncaught errors
+// and unhandled promise rejections over the websocket, to be printed by WsHandler
+func WithConsoleForwarding(forward bool) Option {
+	return func(fs *Fileserver) {
+		fs.forwardConsole = forward
+	}
+}
+
+// WithBuildCommands sets commands to run before reloading, when a file matching their
+// glob has changed. Each spec is formatted as '<glob> -> <command>', such as
+// '*.scss -> sass style.scss style.css'. The commands are run in order, by the shell,
+// within the served directory. If any fails, the browsers show its output instead of
+// reloading.
+func WithBuildCommands(specs ...string) Option {
+	return func(fs *Fileserver) {
+		fs.buildSpecs = append(fs.buildSpecs, specs...)
+	}
+}
+
+// WithMarkdownLayout sets the html/template which markdown pages are rendered into.
+// The template is executed with the .Title, .Content and .Path of the page.
+func WithMarkdownLayout(layoutPath string) Option {
+	return func(fs *Fileserver) {
+		fs.markdownLayout = layoutPath
+	}
+}
+
+// WithSPAFallback serves the fallback page, relative to the served directory, on every
+// route of a single page app which matches no file. Paths within the excluded
+// prefixes, such as '/api', are left as they are.
+func WithSPAFallback(fallback string, excludes ...string) Option {
+	return func(fs *Fileserver) {
+		if fallback != "" {
+			fs.spaFallback = path.Clean("/" + fallback)
+		}
+		fs.spaExcludes = append(fs.spaExcludes, excludes...)
+	}
+}
@@ -0,0 +1,239 @@
+package wsinject
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+)
+
+// sniffLen is the amount of bytes http.DetectContentType considers
+const sniffLen = 512
+
+// overlayFS serves the master directory directly. Only html pages which get the
+// delta-streamer script injected, or their includes expanded, are kept in memory,
+// every other file is read straight from master. Nothing is injected unless inject
+// is set.
+type overlayFS struct {
+	master    fs.FS
+	inject    bool
+	rules     *injectRules
+	isIgnored func(name string, isDir bool) bool
+	// expand the includes of the html page, if set, returning the latest modification
+	// time of the included files
+	expand func(name string, b []byte) ([]byte, time.Time)
+
+	entriesMu *sync.Mutex
+	entries   map[string]overlayEntry
+}
+
+// overlayEntry is the result of inspecting a file of master. Content is nil if
+// the file isn't injected.
+type overlayEntry struct {
+	modTime time.Time
+	size    int64
+	content []byte
+	// contentModTime is the latest modification time of the file and its includes,
+	// which the content is served with
+	contentModTime time.Time
+}
+
+func newOverlayFS(master fs.FS, inject bool, rules *injectRules, isIgnored func(name string, isDir bool) bool) *overlayFS {
+	return &overlayFS{
+		master:    master,
+		inject:    inject,
+		rules:     rules,
+		isIgnored: isIgnored,
+		entriesMu: &sync.Mutex{},
+		entries:   make(map[string]overlayEntry),
+	}
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := o.master.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if o.isIgnored(name, info.IsDir()) {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if info.IsDir() {
+		d, ok := f.(fs.ReadDirFile)
+		if !ok {
+			return f, nil
+		}
+		return &overlayDir{ReadDirFile: d, name: name, isIgnored: o.isIgnored}, nil
+	}
+	if !o.inject && o.expand == nil {
+		return f, nil
+	}
+
+	entry, cached := o.entry(name)
+	if !cached || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		entry, err = o.inspect(name, f, info)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to inspect: '%v', err: %w", name, err)
+		}
+		o.entriesMu.Lock()
+		o.entries[name] = entry
+		o.entriesMu.Unlock()
+	}
+	if entry.content == nil {
+		// Not injected, the file has to be reopened since it has been read while inspected
+		f.Close()
+		return o.master.Open(name)
+	}
+	f.Close()
+	return &memFile{
+		Reader: bytes.NewReader(entry.content),
+		info:   memFileInfo{FileInfo: info, size: int64(len(entry.content)), modTime: entry.contentModTime},
+	}, nil
+}
+
+func (o *overlayFS) entry(name string) (overlayEntry, bool) {
+	o.entriesMu.Lock()
+	defer o.entriesMu.Unlock()
+	e, ok := o.entries[name]
+	return e, ok
+}
+
+// inspect the file by its name and sniffed content type, only reading the whole
+// file if it may be injected
+func (o *overlayFS) inspect(name string, f fs.File, info fs.FileInfo) (overlayEntry, error) {
+	entry := overlayEntry{modTime: info.ModTime(), size: info.Size(), contentModTime: info.ModTime()}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return entry, err
+	}
+	head = head[:n]
+	if !o.rules.match(name, http.DetectContentType(head)) {
+		return entry, nil
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return entry, err
+	}
+	b := append(head, rest...)
+	var expanded bool
+	if o.expand != nil {
+		e, includedModTime := o.expand(name, b)
+		expanded = !bytes.Equal(e, b)
+		b = e
+		if includedModTime.After(entry.contentModTime) {
+			// Otherwise browsers revalidating the page would keep the stale includes
+			entry.contentModTime = includedModTime
+		}
+	}
+	strategy := injectNone
+	if o.inject {
+		strategy, b = injectWebsocketScript(o.rules, name, b)
+	}
+	if expanded {
+		// Kept in memory even if opted out of injection
+		entry.content = b
+	}
+	if strategy != injectNone {
+		ancli.PrintfNotice("injected delta-streamer script loading tag in: '%v', using strategy: '%v'", name, strategy)
+		entry.content = b
+	}
+	return entry, nil
+}
+
+// invalidate the entry of name, and every entry within it if it's a directory
+func (o *overlayFS) invalidate(name string) {
+	o.entriesMu.Lock()
+	defer o.entriesMu.Unlock()
+	for cached := range o.entries {
+		if cached == name || strings.HasPrefix(cached, name+"/") {
+			delete(o.entries, cached)
+		}
+	}
+}
+
+// overlayDir hides ignored entries from directory listings
+type overlayDir struct {
+	fs.ReadDirFile
+	name      string
+	isIgnored func(name string, isDir bool) bool
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		entries = d.visible(entries)
+		// A partial read may not return an empty result without an error, so keep
+		// reading until something is visible
+		if n <= 0 || len(entries) > 0 || err != nil {
+			return entries, err
+		}
+	}
+}
+
+func (d *overlayDir) visible(entries []fs.DirEntry) []fs.DirEntry {
+	visible := entries[:0]
+	for _, e := range entries {
+		if !d.isIgnored(path.Join(d.name, e.Name()), e.IsDir()) {
+			visible = append(visible, e)
+		}
+	}
+	return visible
+}
+
+// memFile is an in-memory file, seekable so that it may be served by http.FileServer
+type memFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (m *memFile) Stat() (fs.FileInfo, error) {
+	return m.info, nil
+}
+
+func (m *memFile) Close() error {
+	return nil
+}
+
+// memFileInfo is the info of the master file, with the size and modification time of
+// the in-memory content
+type memFileInfo struct {
+	fs.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i memFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+// FS returns the filesystem to serve, which is the mirror or the in-memory overlay
+// of master, depending on mode
+func (fs *Fileserver) FS() fs.FS {
+	if fs.overlay != nil {
+		return fs.overlay
+	}
+	return os.DirFS(fs.mirrorPath)
+}
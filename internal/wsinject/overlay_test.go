@@ -0,0 +1,120 @@
+package wsinject
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+	"github.com/fsnotify/fsnotify"
+)
+
+func Test_overlayFS(t *testing.T) {
+	setup := func(t *testing.T) (*Fileserver, string) {
+		t.Helper()
+		tmpDir := t.TempDir()
+		os.WriteFile(path.Join(tmpDir, "index.html"), []byte(mockHtml), 0o644)
+		os.WriteFile(path.Join(tmpDir, "data.bin"), bytes.Repeat([]byte{0, 1, 2}, 1024), 0o644)
+		os.WriteFile(path.Join(tmpDir, "notes.swp"), []byte("swap"), 0o644)
+		os.MkdirAll(path.Join(tmpDir, "nested"), 0o755)
+		os.WriteFile(path.Join(tmpDir, "nested", "page.html"), []byte(mockHtml), 0o644)
+		fs := NewFileServer("/delta-streamer-ws.js", false, WithMode(ModeOverlay))
+		mirrorPath := setupFileServer(t, fs, tmpDir)
+		if mirrorPath != "" {
+			t.Fatalf("expected no mirror to be created, got: '%v'", mirrorPath)
+		}
+		return fs, tmpDir
+	}
+
+	readAll := func(t *testing.T, fsys fs.FS, name string) string {
+		t.Helper()
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open: '%v', err: %v", name, err)
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("failed to read: '%v', err: %v", name, err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatalf("failed to stat: '%v', err: %v", name, err)
+		}
+		if info.Size() != int64(len(b)) {
+			t.Fatalf("expected stat size: %v to equal content size: %v", info.Size(), len(b))
+		}
+		return string(b)
+	}
+
+	t.Run("it should serve injected html pages", func(t *testing.T) {
+		fs, _ := setup(t)
+		testboil.AssertStringContains(t, readAll(t, fs.FS(), "index.html"), ClientScriptPath)
+		testboil.AssertStringContains(t, readAll(t, fs.FS(), "nested/page.html"), ClientScriptPath)
+	})
+
+	t.Run("it should serve other files unmodified from master", func(t *testing.T) {
+		fs, tmpDir := setup(t)
+		want, _ := os.ReadFile(path.Join(tmpDir, "data.bin"))
+		testboil.FailTestIfDiff(t, readAll(t, fs.FS(), "data.bin"), string(want))
+		if _, cached := fs.overlay.entries["data.bin"]; !cached {
+			t.Fatal("expected data.bin to be inspected")
+		}
+		if fs.overlay.entries["data.bin"].content != nil {
+			t.Fatal("expected data.bin to not be kept in memory")
+		}
+	})
+
+	t.Run("it should hide ignored files", func(t *testing.T) {
+		fs, _ := setup(t)
+		_, err := fs.FS().Open("notes.swp")
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+		f, err := fs.FS().Open(".")
+		if err != nil {
+			t.Fatalf("failed to open root: %v", err)
+		}
+		defer f.Close()
+		entries, err := f.(interface {
+			ReadDir(int) ([]os.DirEntry, error)
+		}).ReadDir(-1)
+		if err != nil {
+			t.Fatalf("failed to read root: %v", err)
+		}
+		for _, e := range entries {
+			if e.Name() == "notes.swp" {
+				t.Fatal("expected ignored file to be hidden from listing")
+			}
+		}
+	})
+
+	t.Run("it should invalidate entries on file events", func(t *testing.T) {
+		fs, tmpDir := setup(t)
+		readAll(t, fs.FS(), "index.html")
+		p := path.Join(tmpDir, "index.html")
+		os.WriteFile(p, []byte(strings.Replace(mockHtml, "<title></title>", "<title>changed</title>", 1)), 0o644)
+		got := fs.handleFileEvent(fsnotify.Event{Name: p, Op: fsnotify.Write})
+		testboil.FailTestIfDiff(t, len(got), 1)
+		if _, cached := fs.overlay.entries["index.html"]; cached {
+			t.Fatal("expected entry to be invalidated")
+		}
+		testboil.AssertStringContains(t, readAll(t, fs.FS(), "index.html"), "<title>changed</title>")
+	})
+
+	t.Run("it should not serve stale entries if an event is missed", func(t *testing.T) {
+		fs, tmpDir := setup(t)
+		readAll(t, fs.FS(), "index.html")
+		p := path.Join(tmpDir, "index.html")
+		os.WriteFile(p, []byte(strings.Replace(mockHtml, "<title></title>", "<title>missed</title>", 1)), 0o644)
+		later := time.Now().Add(time.Hour)
+		os.Chtimes(p, later, later)
+		testboil.AssertStringContains(t, readAll(t, fs.FS(), "index.html"), "<title>missed</title>")
+	})
+}
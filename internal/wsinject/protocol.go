@@ -0,0 +1,109 @@
+package wsinject
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// protocolVersion of the messages sent over the delta-streamer websocket. It's bumped
+// on changes which older clients can't handle, additions of fields and message types
+// are backwards compatible.
+const protocolVersion = 1
+
+// supportedVersions of the protocol, the highest one supported by both sides is used
+var supportedVersions = []int{protocolVersion}
+
+// errIncompatible is returned when the client and the server share no protocol version
+var errIncompatible = errors.New("no supported protocol version")
+
+type messageType string
+
+const (
+	// msgHello is sent by the client when connecting, with the protocol versions it supports
+	msgHello messageType = "hello"
+	// msgWelcome is sent by the server as a response to hello, with the agreed version, the
+	// instance id of the server and the sequence number of the latest change
+	msgWelcome messageType = "welcome"
+	// msgChange is sent by the server on every batch of changed files
+	msgChange messageType = "change"
+	// msgError is sent by the server before closing the connection, on failed handshakes
+	msgError messageType = "error"
+	// msgIncompatible is sent by the server before closing the connection, if it shares
+	// no protocol version with the client. Unlike errors, it stops the client from
+	// reconnecting.
+	msgIncompatible messageType = "incompatible"
+	// msgConsole is sent by the client on console output, uncaught errors and unhandled
+	// promise rejections, if console forwarding is enabled
+	msgConsole messageType = "console"
+	// msgBuildFailed is sent by the server when a build command fails, with its output
+	msgBuildFailed messageType = "build-failed"
+	// msgBuildOK is sent by the server when the build commands succeed after a failure
+	msgBuildOK messageType = "build-ok"
+)
+
+type changeKind string
+
+const (
+	changeCreate changeKind = "create"
+	changeWrite  changeKind = "write"
+	changeRemove changeKind = "remove"
+)
+
+// change of a single file
+type change struct {
+	// Path is the root-relative url path the file is served on, such as '/blog/index.html'
+	Path string     `json:"path"`
+	Kind changeKind `json:"kind"`
+	// Hash is the hex encoded sha256 of the file content, empty for removals and directories
+	Hash string `json:"hash,omitempty"`
+}
+
+// message is the envelope of everything sent over the websocket, in both directions
+type message struct {
+	Version  int         `json:"v"`
+	Type     messageType `json:"type"`
+	Versions []int       `json:"versions,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+	Seq      uint64      `json:"seq,omitempty"`
+	Changes  []change    `json:"changes,omitempty"`
+	Error    string      `json:"error,omitempty"`
+
+	// Level of console messages, such as 'log', 'warn' or 'error'
+	Level string   `json:"level,omitempty"`
+	Args  []string `json:"args,omitempty"`
+	// URL of the page which sent the console message
+	URL   string `json:"url,omitempty"`
+	Stack string `json:"stack,omitempty"`
+
+	// Command and Output of failed build commands
+	Command string `json:"command,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// paths of the changes within the message
+func (m message) paths() []string {
+	paths := make([]string, 0, len(m.Changes))
+	for _, c := range m.Changes {
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+// negotiateVersion returns the highest protocol version supported by both the client
+// and the server
+func negotiateVersion(hello message) (int, error) {
+	if hello.Type != msgHello {
+		return 0, fmt.Errorf("expected message of type: '%v', got: '%v'", msgHello, hello.Type)
+	}
+	agreed := 0
+	for _, v := range hello.Versions {
+		if slices.Contains(supportedVersions, v) && v > agreed {
+			agreed = v
+		}
+	}
+	if agreed == 0 {
+		return 0, fmt.Errorf("%w in: %v, server supports: %v", errIncompatible, hello.Versions, supportedVersions)
+	}
+	return agreed, nil
+}
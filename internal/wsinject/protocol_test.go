@@ -0,0 +1,32 @@
+package wsinject
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_negotiateVersion(t *testing.T) {
+	t.Run("it should agree on the highest common version", func(t *testing.T) {
+		got, err := negotiateVersion(message{Type: msgHello, Versions: []int{0, protocolVersion, 99}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		testboil.FailTestIfDiff(t, got, protocolVersion)
+	})
+
+	t.Run("it should fail without any common version", func(t *testing.T) {
+		_, err := negotiateVersion(message{Type: msgHello, Versions: []int{99}})
+		if !errors.Is(err, errIncompatible) {
+			t.Fatalf("expected: %v, got: %v", errIncompatible, err)
+		}
+	})
+
+	t.Run("it should fail on anything but hello", func(t *testing.T) {
+		_, err := negotiateVersion(message{Type: msgChange, Versions: []int{protocolVersion}})
+		if err == nil || errors.Is(err, errIncompatible) {
+			t.Fatalf("expected a handshake error, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package wsinject
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+)
+
+// RenderHandler serves the pages which are rendered from other sources, such as
+// markdown, templates and directory listings, with the delta-streamer script
+// injected. Every other request is passed on to next.
+func (fs *Fileserver) RenderHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		origPath, render, ok := fs.renderSource(r.URL.Path)
+		if !ok {
+			origPath, ok = fs.listingSource(r.URL.Path)
+			if ok {
+				fs.serveListing(w, r, origPath)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		page, err := render(origPath)
+		if err != nil {
+			ancli.Errf("failed to render: '%v', err: %v", origPath, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		route, _ := renderedRoute(origPath)
+		fs.serveRendered(w, r, fs.relPath(route), page)
+	})
+}
+
+// renderSource returns the source of the page requested by urlPath, and how to render
+// it, if it's rendered from markdown or a template
+func (fs *Fileserver) renderSource(urlPath string) (string, func(origPath string) ([]byte, error), bool) {
+	if origPath, ok := fs.markdownSource(urlPath); ok {
+		return origPath, fs.renderMarkdown, true
+	}
+	if origPath, ok := fs.templateSource(urlPath); ok {
+		return origPath, fs.renderTemplate, true
+	}
+	return "", nil, false
+}
+
+// requestedPage returns the path of the page requested by urlPath, relative to master.
+// Directories are requested as their index page, and paths without an extension which
+// match nothing in master as clean urls, such as '/notes' for 'notes.html'.
+func (fs *Fileserver) requestedPage(urlPath string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if strings.HasSuffix(urlPath, "/") {
+		return path.Join(rel, "index.html")
+	}
+	if rel != "" && path.Ext(rel) == "" {
+		_, err := os.Stat(filepath.Join(fs.masterPath, filepath.FromSlash(rel)))
+		if err != nil {
+			return rel + ".html"
+		}
+	}
+	return rel
+}
+
+// serveRendered serves the rendered page, injected as if it was a file at relPath
+func (fs *Fileserver) serveRendered(w http.ResponseWriter, r *http.Request, relPath string, page []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, relPath, time.Time{}, bytes.NewReader(fs.injectRendered(relPath, page)))
+}
+
+// injectRendered injects the delta-streamer script into the page, as if it was a file
+// at relPath
+func (fs *Fileserver) injectRendered(relPath string, page []byte) []byte {
+	strategy, injected := injectWebsocketScript(fs.injectRules, relPath, page)
+	if strategy != injectNone {
+		ancli.PrintfNotice("injected delta-streamer script loading tag into rendered: '%v', using strategy: '%v'", relPath, strategy)
+	}
+	return injected
+}
+
+// serveListing serves the directory listing of the directory at origPath
+func (fs *Fileserver) serveListing(w http.ResponseWriter, r *http.Request, origPath string) {
+	page, err := fs.renderListing(origPath)
+	if err != nil {
+		ancli.Errf("failed to list: '%v', err: %v", origPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fs.serveRendered(w, r, path.Join(fs.relPath(origPath), "index.html"), page)
+}
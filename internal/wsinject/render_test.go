@@ -0,0 +1,133 @@
+package wsinject
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+// renderFixture writes the files, keyed by their path relative to the served
+// directory, and returns a Fileserver serving them
+func renderFixture(t *testing.T, files map[string]string) (*Fileserver, string) {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		p := path.Join(root, name)
+		os.MkdirAll(path.Dir(p), 0o755)
+		os.WriteFile(p, []byte(content), 0o644)
+	}
+	fs := NewFileServer("/delta-streamer-ws", false)
+	fs.masterPath = root
+	err := fs.setupIgnorer()
+	if err != nil {
+		t.Fatalf("failed to setup ignorer: %v", err)
+	}
+	return fs, root
+}
+
+func Test_renderSources(t *testing.T) {
+	fs, root := renderFixture(t, map[string]string{
+		"notes.md":             "# Notes",
+		"docs/index.md":        "# Docs",
+		"about.tmpl.html":      "{{.}}",
+		"team/index.tmpl.html": "{{.}}",
+		"both.md":              "# Both",
+		"both.tmpl.html":       "{{.}}",
+		"both.html":            "<html></html>",
+	})
+	sources := map[string]func(urlPath string) (string, bool){
+		"markdown": fs.markdownSource,
+		"template": fs.templateSource,
+	}
+
+	for _, tc := range []struct {
+		source  string
+		urlPath string
+		want    string
+	}{
+		{source: "markdown", urlPath: "/notes.md", want: path.Join(root, "notes.md")},
+		{source: "markdown", urlPath: "/notes.html", want: path.Join(root, "notes.md")},
+		{source: "markdown", urlPath: "/docs/", want: path.Join(root, "docs", "index.md")},
+		{source: "markdown", urlPath: "/both.md", want: path.Join(root, "both.md")},
+		{source: "markdown", urlPath: "/notes", want: path.Join(root, "notes.md")},
+		{source: "markdown", urlPath: "/docs", want: ""},
+		{source: "markdown", urlPath: "/../notes.md", want: path.Join(root, "notes.md")},
+		{source: "template", urlPath: "/about.html", want: path.Join(root, "about.tmpl.html")},
+		{source: "template", urlPath: "/team/", want: path.Join(root, "team", "index.tmpl.html")},
+		{source: "template", urlPath: "/about.tmpl.html", want: ""},
+		{source: "template", urlPath: "/about", want: path.Join(root, "about.tmpl.html")},
+		{source: "template", urlPath: "/team", want: ""},
+	} {
+		t.Run(tc.source+tc.urlPath, func(t *testing.T) {
+			got, _ := sources[tc.source](tc.urlPath)
+			testboil.FailTestIfDiff(t, got, tc.want)
+		})
+	}
+
+	for source, sourceOf := range sources {
+		t.Run(source+" should leave existing and missing pages be", func(t *testing.T) {
+			for _, urlPath := range []string{"/both.html", "/both", "/missing.html", "/missing"} {
+				got, _ := sourceOf(urlPath)
+				testboil.FailTestIfDiff(t, got, "")
+			}
+		})
+	}
+}
+
+func Test_notifyPageUpdate_rendered(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		files   map[string]string
+		deps    map[string]string
+		changed string
+		want    string
+	}{
+		{
+			desc:    "it should reload the html route of changed markdown",
+			files:   map[string]string{"notes.md": "# Notes"},
+			changed: "notes.md",
+			want:    "/notes.html,/notes.md",
+		},
+		{
+			desc:    "it should reload the markdown using a changed layout",
+			files:   map[string]string{"notes.md": "# Notes", "_layout.html": "{{.Content}}"},
+			deps:    map[string]string{"notes.md": "_layout.html"},
+			changed: "_layout.html",
+			want:    "/_layout.html,/notes.html,/notes.md",
+		},
+		{
+			desc:    "it should reload the html route of a changed template",
+			files:   map[string]string{"team.tmpl.html": "{{.}}"},
+			changed: "team.tmpl.html",
+			want:    "/team.html,/team.tmpl.html",
+		},
+		{
+			desc:    "it should reload the template using changed data",
+			files:   map[string]string{"team.tmpl.html": "{{.}}", "team.json": "{}"},
+			deps:    map[string]string{"team.tmpl.html": "team.json"},
+			changed: "team.json",
+			want:    "/team.html,/team.json,/team.tmpl.html",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			fs, root := renderFixture(t, tc.files)
+			for page, file := range tc.deps {
+				fs.deps.set(path.Join(root, page), path.Join(root, file))
+			}
+			c := make(chan message, 1)
+			fs.registerWs("mock", c)
+			fs.notifyPageUpdate(context.Background(), change{Path: path.Join(root, tc.changed), Kind: changeWrite})
+			select {
+			case got := <-c:
+				testboil.FailTestIfDiff(t, strings.Join(got.paths(), ","), tc.want)
+			case <-time.After(time.Second):
+				t.Fatal("failed to receive message within time")
+			}
+		})
+	}
+}
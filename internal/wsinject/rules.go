@@ -0,0 +1,144 @@
+package wsinject
+
+import (
+	"bytes"
+	"mime"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// typeRulePrefix marks a rule which matches the sniffed content type
+	typeRulePrefix = "type:"
+	// optOutComment opts a page out of injection if found within its head, as
+	// does a <meta name="wd-41" content="no-inject"> tag
+	optOutComment = "wd-41:no-inject"
+)
+
+var (
+	defaultInjectIncludes = []string{".html", ".htm", typeRulePrefix + "text/html"}
+	// defaultInjectExcludes are files which may sniff as html, while not being pages
+	defaultInjectExcludes = []string{".svg", ".xml"}
+)
+
+// injectRule matches files by extension, if the pattern starts with '.', by
+// sniffed content type, if it starts with 'type:', or else by gitignore-styled glob
+type injectRule struct {
+	include   bool
+	ext       string
+	mediaType string
+	glob      *ignorer
+}
+
+func parseInjectRule(pattern string, include bool) injectRule {
+	r := injectRule{include: include}
+	switch {
+	case strings.HasPrefix(pattern, typeRulePrefix):
+		r.mediaType = strings.TrimPrefix(pattern, typeRulePrefix)
+	case strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "/*?["):
+		r.ext = strings.ToLower(pattern)
+	default:
+		r.glob = &ignorer{}
+		r.glob.add(pattern)
+	}
+	return r
+}
+
+func (r injectRule) matches(relPath, contentType string) bool {
+	switch {
+	case r.mediaType != "":
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		return mediaType == r.mediaType
+	case r.ext != "":
+		return strings.ToLower(path.Ext(relPath)) == r.ext
+	default:
+		return r.glob.match(strings.TrimPrefix(relPath, "/"), false)
+	}
+}
+
+// injectRules decide which files get the delta-streamer script injected. The first
+// matching rule wins, in order: user excludes, user includes, default excludes and
+// default includes. Files not matching any rule aren't injected.
+type injectRules struct {
+	rules []injectRule
+}
+
+func newInjectRules(includes, excludes []string) *injectRules {
+	r := &injectRules{}
+	for _, group := range []struct {
+		patterns []string
+		include  bool
+	}{
+		{excludes, false},
+		{includes, true},
+		{defaultInjectExcludes, false},
+		{defaultInjectIncludes, true},
+	} {
+		for _, p := range group.patterns {
+			r.rules = append(r.rules, parseInjectRule(p, group.include))
+		}
+	}
+	return r
+}
+
+// match the slash separated relPath, and contentType which is either sniffed or
+// set by a response header
+func (r *injectRules) match(relPath, contentType string) bool {
+	for _, rule := range r.rules {
+		if rule.matches(relPath, contentType) {
+			return rule.include
+		}
+	}
+	return false
+}
+
+// optedOut checks if the page has opted out of injection by a comment containing
+// 'wd-41:no-inject', or a <meta name="wd-41" content="no-inject"> tag. Only the
+// head is searched, the same part which is seen before streaming an injected
+// response, so that every mode agrees on it.
+func optedOut(b []byte) bool {
+	if !bytes.Contains(b, []byte("wd-41")) {
+		return false
+	}
+	z := html.NewTokenizer(bytes.NewReader(b))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return false
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				return false
+			}
+		case html.CommentToken:
+			if strings.Contains(string(z.Text()), optOutComment) {
+				return true
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) == "body" {
+				return false
+			}
+			if string(name) != "meta" || !hasAttr {
+				continue
+			}
+			var metaName, content string
+			for {
+				key, val, more := z.TagAttr()
+				switch string(key) {
+				case "name":
+					metaName = string(val)
+				case "content":
+					content = string(val)
+				}
+				if !more {
+					break
+				}
+			}
+			if metaName == "wd-41" && content == "no-inject" {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package wsinject
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_injectRules(t *testing.T) {
+	const htmlCommentStart = "<!-- long license header -->"
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		relPath  string
+		content  string
+		want     bool
+	}{
+		{"it should inject html by extension, even if it doesn't sniff as html", nil, nil, "page.html", "{{ template \"base\" }}", true},
+		{"it should inject htm by extension", nil, nil, "PAGE.HTM", "{{ x }}", true},
+		{"it should inject extensionless files which sniff as html", nil, nil, "page", mockHtml, true},
+		{"it should not inject svg which sniffs as html", nil, nil, "icon.svg", htmlCommentStart + "<svg></svg>", false},
+		{"it should not inject xml which sniffs as html", nil, nil, "feed.xml", htmlCommentStart + "<rss></rss>", false},
+		{"it should not inject other files", nil, nil, "style.css", "body {}", false},
+		{"it should inject included extensions", []string{".tmpl"}, nil, "page.tmpl", "{{ x }}", true},
+		{"it should inject included globs", []string{"templates/**"}, nil, "templates/a/b.txt", "x", true},
+		{"it should inject included content types", []string{"type:text/plain"}, nil, "notes.txt", "plain text", true},
+		{"it should let user includes override default excludes", []string{".svg"}, nil, "icon.svg", "<svg></svg>", true},
+		{"it should not inject excluded globs", nil, []string{"fragments/*.html"}, "fragments/nav.html", mockHtml, false},
+		{"it should let excludes override includes", []string{".html"}, []string{"*.html"}, "page.html", mockHtml, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rules := newInjectRules(tc.includes, tc.excludes)
+			strategy, _ := injectWebsocketScript(rules, tc.relPath, []byte(tc.content))
+			got := strategy != injectNone
+			if got != tc.want {
+				t.Fatalf("expected injected: %v, got: %v (strategy: '%v')", tc.want, got, strategy)
+			}
+		})
+	}
+}
+
+func Test_optedOut(t *testing.T) {
+	tests := []struct {
+		name  string
+		given string
+		want  bool
+	}{
+		{"it should not opt out regular pages", mockHtml, false},
+		{"it should opt out on marker comment", "<html><!-- wd-41:no-inject --><head></head></html>", true},
+		{"it should opt out on meta tag", `<html><head><meta name="wd-41" content="no-inject"></head></html>`, true},
+		{"it should opt out on self closing meta tag", `<head><meta content="no-inject" name="wd-41" /></head>`, true},
+		{"it should not opt out on other meta tags", `<head><meta name="wd-41" content="something-else"></head>`, false},
+		{"it should not opt out on marker outside of comments", `<body><p>wd-41:no-inject</p></body>`, false},
+		{"it should not opt out on marker after the head", "<html><head></head><body><!-- wd-41:no-inject --></body></html>", false},
+		{"it should not opt out on marker within the body", "<html><body><!-- wd-41:no-inject --></body></html>", false},
+		{"it should opt out on marker in pages without head or body", "<!-- wd-41:no-inject --><p>hi</p>", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testboil.FailTestIfDiff(t, optedOut([]byte(tc.given)), tc.want)
+		})
+	}
+}
+
+func Test_Setup_injectRules(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(path.Join(tmpDir, "index.html"), []byte(mockHtml), 0o644)
+	os.WriteFile(path.Join(tmpDir, "icon.svg"), []byte("<!-- icon --><svg></svg>"), 0o644)
+	os.WriteFile(path.Join(tmpDir, "opted-out.html"), []byte(strings.Replace(mockHtml, "<head>", "<head><!-- wd-41:no-inject -->", 1)), 0o644)
+	fs := NewFileServer("/delta-streamer-ws.js", false)
+	setupFileServer(t, fs, tmpDir)
+	for name, want := range map[string]bool{
+		"index.html":     true,
+		"icon.svg":       false,
+		"opted-out.html": false,
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(path.Join(fs.mirrorPath, name))
+			if err != nil {
+				t.Fatalf("failed to read mirrored file: %v", err)
+			}
+			testboil.FailTestIfDiff(t, strings.Contains(string(b), deltaStreamer), want)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package wsinject
+
+import (
+	iofs "io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SPAHandler answers the requests for routes of a single page app, meaning paths
+// without an extension which match neither a file nor a rendered page, with the
+// fallback page. Everything else, including requests within the excluded prefixes, is
+// passed on to next. The fallback page is served by next as well, so it's injected
+// like any other page.
+func (fs *Fileserver) SPAHandler(next http.Handler) http.Handler {
+	if fs.spaFallback == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !fs.isSPARoute(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fallback := r.Clone(r.Context())
+		fallback.URL.Path = fs.spaFallback
+		fallback.URL.RawPath = ""
+		// http.FileServer redirects index.html to its directory, so it's requested directly
+		if path.Base(fs.spaFallback) == "index.html" {
+			fallback.URL.Path = strings.TrimSuffix(fs.spaFallback, "index.html")
+		}
+		next.ServeHTTP(w, fallback)
+	})
+}
+
+// isSPARoute checks if the request path should be answered with the fallback page
+func (fs *Fileserver) isSPARoute(urlPath string) bool {
+	p := path.Clean("/" + urlPath)
+	for _, prefix := range fs.spaExcludes {
+		prefix = path.Clean("/" + prefix)
+		if p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/") {
+			return false
+		}
+	}
+	// Requests for assets, such as a missing bundle, should fail rather than get html
+	if path.Ext(p) != "" {
+		return false
+	}
+	rel := strings.TrimPrefix(p, "/")
+	if rel == "" {
+		rel = "."
+	}
+	if _, err := iofs.Stat(fs.FS(), rel); err == nil {
+		return false
+	}
+	// Only fall back once the render layer misses, so that clean urls of markdown and
+	// templates are rendered
+	_, _, rendered := fs.renderSource(p)
+	return !rendered
+}
@@ -0,0 +1,57 @@
+package wsinject
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func TestSPAHandler(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(path.Join(root, "assets"), 0o755)
+	os.WriteFile(path.Join(root, "index.html"), []byte("<html><head></head><body>app</body></html>"), 0o644)
+	os.WriteFile(path.Join(root, "about.html"), []byte("<html><head></head><body>about</body></html>"), 0o644)
+	os.WriteFile(path.Join(root, "assets", "main.js"), []byte("main"), 0o644)
+	os.WriteFile(path.Join(root, "docs.md"), []byte("# Docs"), 0o644)
+	fs := NewFileServer("/delta-streamer-ws", false, WithSPAFallback("index.html", "/api"))
+	setupFileServer(t, fs, root)
+	h := fs.SPAHandler(fs.RenderHandler(http.FileServer(http.FS(fs.FS()))))
+
+	for _, tc := range []struct {
+		desc     string
+		urlPath  string
+		wantCode int
+		want     string
+	}{
+		{desc: "it should answer unknown routes with the injected fallback", urlPath: "/dashboard/settings", wantCode: http.StatusOK, want: ClientScriptPath},
+		{desc: "it should answer unknown directories with the fallback", urlPath: "/dashboard/", wantCode: http.StatusOK, want: "app"},
+		{desc: "it should serve existing files as they are", urlPath: "/about.html", wantCode: http.StatusOK, want: "about"},
+		{desc: "it should serve existing directories as they are", urlPath: "/assets/", wantCode: http.StatusOK, want: "main.js"},
+		{desc: "it should serve the root as it is", urlPath: "/", wantCode: http.StatusOK, want: "app"},
+		{desc: "it should not answer missing assets with the fallback", urlPath: "/assets/missing.js", wantCode: http.StatusNotFound, want: "404"},
+		{desc: "it should not answer excluded prefixes with the fallback", urlPath: "/api/users", wantCode: http.StatusNotFound, want: "404"},
+		{desc: "it should only exclude whole path segments", urlPath: "/apiary", wantCode: http.StatusOK, want: "app"},
+		{desc: "it should render markdown rather than fall back", urlPath: "/docs", wantCode: http.StatusOK, want: `<h1 id="docs">Docs</h1>`},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.urlPath, nil))
+			testboil.FailTestIfDiff(t, rec.Code, tc.wantCode)
+			b, _ := io.ReadAll(rec.Body)
+			testboil.AssertStringContains(t, string(b), tc.want)
+		})
+	}
+
+	t.Run("it should pass everything on when disabled", func(t *testing.T) {
+		fs := NewFileServer("/delta-streamer-ws", false)
+		fs.mirrorPath = root
+		rec := httptest.NewRecorder()
+		fs.SPAHandler(http.FileServer(http.Dir(root))).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+		testboil.FailTestIfDiff(t, rec.Code, http.StatusNotFound)
+	})
+}
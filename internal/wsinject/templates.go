@@ -0,0 +1,85 @@
+package wsinject
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	templateExt = ".tmpl.html"
+	dataExt     = ".json"
+)
+
+// templateSource returns the template which should be rendered for the request path,
+// if any. Templates are rendered when the html page, or directory index, is requested
+// and only the template exists.
+func (fs *Fileserver) templateSource(urlPath string) (string, bool) {
+	rel := fs.requestedPage(urlPath)
+	if path.Ext(rel) != ".html" || strings.HasSuffix(rel, templateExt) {
+		return "", false
+	}
+	if fileExists(filepath.Join(fs.masterPath, filepath.FromSlash(rel))) {
+		return "", false
+	}
+	origPath := filepath.Join(fs.masterPath, filepath.FromSlash(strings.TrimSuffix(rel, ".html")+templateExt))
+	if !fileExists(origPath) || fs.isIgnored(origPath, false) {
+		return "", false
+	}
+	return origPath, true
+}
+
+// templateData returns the path of the data file of the template at origPath, such as
+// 'team.json' for 'team.tmpl.html'
+func templateData(origPath string) string {
+	return strings.TrimSuffix(origPath, templateExt) + dataExt
+}
+
+// renderTemplate executes the template at origPath with the content of its data file,
+// if there is one
+func (fs *Fileserver) renderTemplate(origPath string) ([]byte, error) {
+	dataPath := templateData(origPath)
+	// Depend on the data file even if it's missing, so that the page is rendered again
+	// once it exists
+	fs.deps.set(origPath, dataPath)
+	tmpl, err := template.ParseFiles(origPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+	var data any
+	b, err := os.ReadFile(dataPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read template data: %w", err)
+	default:
+		err = json.Unmarshal(b, &data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template data: '%v', err: %w", fs.relPath(dataPath), err)
+		}
+	}
+	var page bytes.Buffer
+	err = tmpl.Execute(&page, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute template: %w", err)
+	}
+	return page.Bytes(), nil
+}
+
+// renderedRoute returns the html route which the source at p is rendered to, if p is
+// a source of a rendered page
+func renderedRoute(p string) (string, bool) {
+	switch {
+	case strings.HasSuffix(p, templateExt):
+		return strings.TrimSuffix(p, templateExt) + ".html", true
+	case strings.HasSuffix(p, markdownExt):
+		return strings.TrimSuffix(p, markdownExt) + ".html", true
+	}
+	return "", false
+}
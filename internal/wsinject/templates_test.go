@@ -0,0 +1,92 @@
+package wsinject
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/testboil"
+)
+
+func Test_renderTemplate(t *testing.T) {
+	setup := func(t *testing.T, tmpl, data string) (*Fileserver, string) {
+		t.Helper()
+		root := t.TempDir()
+		src := path.Join(root, "team.tmpl.html")
+		os.WriteFile(src, []byte(tmpl), 0o644)
+		if data != "" {
+			os.WriteFile(path.Join(root, "team.json"), []byte(data), 0o644)
+		}
+		fs := NewFileServer("/delta-streamer-ws", false)
+		fs.masterPath = root
+		return fs, src
+	}
+
+	t.Run("it should execute the template with its data, and depend on it", func(t *testing.T) {
+		fs, src := setup(t, `<ul>{{range .members}}<li>{{.}}</li>{{end}}</ul>`, `{"members": ["ada", "<bob>"]}`)
+		got, err := fs.renderTemplate(src)
+		if err != nil {
+			t.Fatalf("failed to render: %v", err)
+		}
+		testboil.FailTestIfDiff(t, string(got), "<ul><li>ada</li><li>&lt;bob&gt;</li></ul>")
+		testboil.FailTestIfDiff(t, strings.Join(fs.deps.of(path.Join(fs.masterPath, "team.json")), ","), src)
+	})
+
+	t.Run("it should execute the template without data, if there is none", func(t *testing.T) {
+		fs, src := setup(t, `<p>{{if .}}data{{else}}none{{end}}</p>`, "")
+		got, err := fs.renderTemplate(src)
+		if err != nil {
+			t.Fatalf("failed to render: %v", err)
+		}
+		testboil.FailTestIfDiff(t, string(got), "<p>none</p>")
+	})
+
+	for _, tc := range []struct {
+		desc string
+		tmpl string
+		data string
+		want string
+	}{
+		{desc: "broken templates", tmpl: "{{.title", want: "failed to parse template"},
+		{desc: "broken data", tmpl: "{{.title}}", data: "{", want: "failed to parse template data: 'team.json'"},
+		{desc: "failed executions", tmpl: "{{template \"missing\"}}", want: "failed to execute template"},
+	} {
+		t.Run("it should fail on "+tc.desc, func(t *testing.T) {
+			fs, src := setup(t, tc.tmpl, tc.data)
+			_, err := fs.renderTemplate(src)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			testboil.AssertStringContains(t, err.Error(), tc.want)
+		})
+	}
+}
+
+func TestRenderHandler_template(t *testing.T) {
+	fs, root := renderFixture(t, map[string]string{
+		"team.tmpl.html": `<html><head><title>{{.title}}</title></head><body></body></html>`,
+		"team.json":      `{"title": "Team"}`,
+	})
+	h := fs.RenderHandler(http.FileServer(http.Dir(root)))
+
+	t.Run("it should serve the injected template on its html route", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/team.html", nil))
+		testboil.FailTestIfDiff(t, rec.Code, http.StatusOK)
+		testboil.FailTestIfDiff(t, rec.Header().Get("Content-Type"), "text/html; charset=utf-8")
+		b, _ := io.ReadAll(rec.Body)
+		testboil.AssertStringContains(t, string(b), "<title>Team</title>")
+		testboil.AssertStringContains(t, string(b), ClientScriptPath)
+	})
+
+	t.Run("it should fail with the error on broken data", func(t *testing.T) {
+		os.WriteFile(path.Join(root, "team.json"), []byte(`{`), 0o644)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/team.html", nil))
+		testboil.FailTestIfDiff(t, rec.Code, http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,260 @@
+package wsinject
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watcher detects changes of the entries within the directories added to it,
+// non-recursively. Both backends report changes as fsnotify events, so that
+// they feed the same event pipeline.
+type watcher interface {
+	Add(name string) error
+	Remove(name string) error
+	WatchList() []string
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+type fsnotifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func newFsnotifyWatcher() (*fsnotifyWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifyWatcher{Watcher: w}, nil
+}
+
+func (w *fsnotifyWatcher) Events() <-chan fsnotify.Event {
+	return w.Watcher.Events
+}
+
+func (w *fsnotifyWatcher) Errors() <-chan error {
+	return w.Watcher.Errors
+}
+
+type entryStat struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+	hash    [sha256.Size]byte
+}
+
+// pollWatcher detects changes by stating the entries of every watched directory each
+// interval, for filesystems where inotify events never fire, such as bind mounts,
+// NFS and sshfs. Entries are compared by mtime and size or, if hashing, by content.
+type pollWatcher struct {
+	interval time.Duration
+	hash     bool
+
+	dirsMu *sync.Mutex
+	dirs   map[string]map[string]entryStat
+
+	events    chan fsnotify.Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func newPollWatcher(interval time.Duration, hash bool) *pollWatcher {
+	w := &pollWatcher{
+		interval:  interval,
+		hash:      hash,
+		dirsMu:    &sync.Mutex{},
+		dirs:      make(map[string]map[string]entryStat),
+		events:    make(chan fsnotify.Event),
+		errors:    make(chan error),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	go w.poll()
+	return w
+}
+
+func (w *pollWatcher) Add(name string) error {
+	snapshot, err := w.snapshot(name)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot: '%v', err: %w", name, err)
+	}
+	w.dirsMu.Lock()
+	defer w.dirsMu.Unlock()
+	w.dirs[name] = snapshot
+	return nil
+}
+
+func (w *pollWatcher) Remove(name string) error {
+	w.dirsMu.Lock()
+	defer w.dirsMu.Unlock()
+	if _, ok := w.dirs[name]; !ok {
+		return fsnotify.ErrNonExistentWatch
+	}
+	delete(w.dirs, name)
+	return nil
+}
+
+func (w *pollWatcher) WatchList() []string {
+	w.dirsMu.Lock()
+	defer w.dirsMu.Unlock()
+	list := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		list = append(list, dir)
+	}
+	return list
+}
+
+func (w *pollWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *pollWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *pollWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	return nil
+}
+
+func (w *pollWatcher) snapshot(dir string) (map[string]entryStat, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]entryStat, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stat := entryStat{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			mode:    info.Mode(),
+		}
+		if w.hash && info.Mode().IsRegular() {
+			stat.hash, err = hashFile(filepath.Join(dir, entry.Name()))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		snapshot[entry.Name()] = stat
+	}
+	return snapshot, nil
+}
+
+func hashFile(p string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(p)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func (w *pollWatcher) poll() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			for _, ev := range w.scan() {
+				select {
+				case w.events <- ev:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// scan every watched directory and return the events of the differences since
+// the previous scan
+func (w *pollWatcher) scan() []fsnotify.Event {
+	var events []fsnotify.Event
+	dirs := w.WatchList()
+	slices.Sort(dirs)
+	for _, dir := range dirs {
+		current, err := w.snapshot(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			// Network filesystems may fail intermittently, try again next poll
+			ancli.Errf("poll watcher failed to scan: '%v', err: %v", dir, err)
+			continue
+		}
+
+		w.dirsMu.Lock()
+		previous, stillWatched := w.dirs[dir]
+		if !stillWatched {
+			w.dirsMu.Unlock()
+			continue
+		}
+		if current == nil {
+			// The directory is gone, drop it like inotify drops watches of removed directories
+			delete(w.dirs, dir)
+		} else {
+			w.dirs[dir] = current
+		}
+		w.dirsMu.Unlock()
+
+		events = append(events, w.diff(dir, previous, current)...)
+	}
+	return events
+}
+
+func (w *pollWatcher) diff(dir string, previous, current map[string]entryStat) []fsnotify.Event {
+	var events []fsnotify.Event
+	for name, curr := range current {
+		p := filepath.Join(dir, name)
+		prev, existed := previous[name]
+		switch {
+		case !existed:
+			events = append(events, fsnotify.Event{Name: p, Op: fsnotify.Create})
+		case prev.mode.IsDir() != curr.mode.IsDir():
+			// Replaced by another kind of entry
+			events = append(events,
+				fsnotify.Event{Name: p, Op: fsnotify.Remove},
+				fsnotify.Event{Name: p, Op: fsnotify.Create})
+		case curr.mode.IsDir():
+			// Directory content is polled on its own, if it's watched
+		case w.hash && prev.hash != curr.hash:
+			events = append(events, fsnotify.Event{Name: p, Op: fsnotify.Write})
+		case !w.hash && (!prev.modTime.Equal(curr.modTime) || prev.size != curr.size):
+			events = append(events, fsnotify.Event{Name: p, Op: fsnotify.Write})
+		case prev.mode != curr.mode:
+			events = append(events, fsnotify.Event{Name: p, Op: fsnotify.Chmod})
+		}
+	}
+	for name := range previous {
+		if _, exists := current[name]; !exists {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+		}
+	}
+	return events
+}
@@ -0,0 +1,104 @@
+package wsinject
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func Test_watcher(t *testing.T) {
+	backends := map[string]func(t *testing.T) watcher{
+		"fsnotify": func(t *testing.T) watcher {
+			w, err := newFsnotifyWatcher()
+			if err != nil {
+				t.Fatalf("failed to create fsnotify watcher: %v", err)
+			}
+			return w
+		},
+		"poll": func(t *testing.T) watcher {
+			return newPollWatcher(5*time.Millisecond, false)
+		},
+		"poll with hashing": func(t *testing.T) watcher {
+			return newPollWatcher(5*time.Millisecond, true)
+		},
+	}
+
+	for name, newWatcher := range backends {
+		setup := func(t *testing.T) (watcher, string) {
+			t.Helper()
+			dir := t.TempDir()
+			w := newWatcher(t)
+			t.Cleanup(func() { w.Close() })
+			err := w.Add(dir)
+			if err != nil {
+				t.Fatalf("failed to add dir: %v", err)
+			}
+			return w, dir
+		}
+
+		awaitEvent := func(t *testing.T, w watcher, name string, op fsnotify.Op) {
+			t.Helper()
+			timeout := time.After(time.Second)
+			for {
+				select {
+				case ev := <-w.Events():
+					if ev.Name == name && ev.Has(op) {
+						return
+					}
+				case err := <-w.Errors():
+					t.Fatalf("got watcher error: %v", err)
+				case <-timeout:
+					t.Fatalf("failed to receive %v event of: '%v' within time", op, name)
+				}
+			}
+		}
+
+		t.Run(name, func(t *testing.T) {
+			t.Run("it should send create event on new files", func(t *testing.T) {
+				w, dir := setup(t)
+				p := path.Join(dir, "new.html")
+				os.WriteFile(p, []byte(mockHtml), 0o644)
+				awaitEvent(t, w, p, fsnotify.Create)
+			})
+
+			t.Run("it should send create event on new directories", func(t *testing.T) {
+				w, dir := setup(t)
+				p := path.Join(dir, "nested")
+				os.Mkdir(p, 0o755)
+				awaitEvent(t, w, p, fsnotify.Create)
+			})
+
+			t.Run("it should send write event on changed files", func(t *testing.T) {
+				w, dir := setup(t)
+				p := path.Join(dir, "existing.html")
+				os.WriteFile(p, []byte(mockHtml), 0o644)
+				awaitEvent(t, w, p, fsnotify.Create)
+				os.WriteFile(p, []byte("changes!"), 0o644)
+				awaitEvent(t, w, p, fsnotify.Write)
+			})
+
+			t.Run("it should send remove event on removed files", func(t *testing.T) {
+				w, dir := setup(t)
+				p := path.Join(dir, "removed.html")
+				os.WriteFile(p, []byte(mockHtml), 0o644)
+				awaitEvent(t, w, p, fsnotify.Create)
+				os.Remove(p)
+				awaitEvent(t, w, p, fsnotify.Remove)
+			})
+
+			t.Run("it should stop watching removed watches", func(t *testing.T) {
+				w, dir := setup(t)
+				err := w.Remove(dir)
+				if err != nil {
+					t.Fatalf("failed to remove watch: %v", err)
+				}
+				if len(w.WatchList()) != 0 {
+					t.Fatalf("expected empty watch list, got: %v", w.WatchList())
+				}
+			})
+		})
+	}
+}
@@ -3,74 +3,155 @@ package wsinject
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
-	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/baalimago/go_away_boilerplate/pkg/ancli"
 	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/html"
 )
 
 type Fileserver struct {
-	masterPath  string
-	mirrorPath  string
+	masterPath string
+	mirrorPath string
+	mirrorDir  string
+	// tmpDir is where temporary mirrors are created, and stale ones removed
+	tmpDir      string
 	forceReload bool
-	expectTLS   bool
-	wsPort      int
 	wsPath      string
-	watcher     *fsnotify.Watcher
+	publicURL   string
+	watcher     watcher
+	debounce    time.Duration
+	mode        Mode
+	overlay     *overlayFS
 
-	pageReloadChan        chan string
+	// poll makes the poll watcher be used instead of fsnotify
+	poll         bool
+	pollInterval time.Duration
+	pollHash     bool
+
+	ignorePatterns   []string
+	respectGitignore bool
+	ignore           *ignorer
+
+	injectRules *injectRules
+
+	// forwardConsole makes the browsers send their console output upstream
+	forwardConsole bool
+
+	// spaFallback is the url path of the page which single page app routes are
+	// answered with, if set
+	spaFallback string
+	spaExcludes []string
+
+	// markdownLayout is the template which markdown is rendered into, if set
+	markdownLayout string
+	// deps of the pages built from other files
+	deps dependencies
+
+	buildSpecs []string
+	builds     []buildCommand
+	buildState buildState
+
+	// instanceID identifies this server, so that clients can tell restarts from reconnects
+	instanceID            string
+	seq                   atomic.Uint64
+	pageReloadChan        chan message
 	wsDispatcher          sync.Map
 	wsDispatcherStarted   *bool
 	wsDispatcherStartedMu *sync.Mutex
 }
 
-var ErrNoHeaderTagFound = errors.New("no header tag found")
+// ClientScriptPath is the reserved, absolute, route which the delta-streamer script
+// is served on, so that it resolves from pages at any depth
+const ClientScriptPath = "/__wd41/client.js"
 
 const deltaStreamer = `<!-- This script has been injected by wd-41 and allows hot reloads -->
-<script type="module" src="delta-streamer.js"></script>`
+<script type="module" src="` + ClientScriptPath + `"></script>`
 
-func NewFileServer(wsPort int, wsPath string, forceReload, expectTLS bool) *Fileserver {
-	mirrorDir, err := os.MkdirTemp("", "wd-41_*")
-	if err != nil {
-		panic(err)
-	}
+func NewFileServer(wsPath string, forceReload bool, opts ...Option) *Fileserver {
 	started := false
-	return &Fileserver{
-		mirrorPath:            mirrorDir,
-		wsPort:                wsPort,
+	fs := &Fileserver{
+		mode:                  ModeMirror,
+		tmpDir:                os.TempDir(),
 		wsPath:                wsPath,
-		expectTLS:             expectTLS,
 		forceReload:           forceReload,
-		pageReloadChan:        make(chan string),
+		respectGitignore:      true,
+		injectRules:           newInjectRules(nil, nil),
+		instanceID:            fmt.Sprintf("%x", rand.Uint64()),
+		pageReloadChan:        make(chan message),
 		wsDispatcher:          sync.Map{},
 		wsDispatcherStarted:   &started,
 		wsDispatcherStartedMu: &sync.Mutex{},
 	}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	return fs
 }
 
-func (fs *Fileserver) mirrorFile(origPath string) error {
-	relativePath := strings.ReplaceAll(origPath, fs.masterPath, "")
-	fileB, err := os.ReadFile(origPath)
+func (fs *Fileserver) mirroredPath(origPath string) string {
+	return path.Join(fs.mirrorPath, strings.ReplaceAll(origPath, fs.masterPath, ""))
+}
+
+// relPath returns the slash separated path of origPath, relative to master
+func (fs *Fileserver) relPath(origPath string) string {
+	rel, err := filepath.Rel(fs.masterPath, origPath)
 	if err != nil {
-		return fmt.Errorf("failed to read file on path: '%v', err: %v", origPath, err)
+		return origPath
 	}
-	injected, injectedBytes, err := injectWebsocketScript(fileB)
+	return filepath.ToSlash(rel)
+}
+
+// urlPath of origPath, as requested by the browser
+func (fs *Fileserver) urlPath(origPath string) string {
+	return path.Join("/", fs.relPath(origPath))
+}
+
+// urlPaths which origPath is served on. Rendered sources are also served on the html
+// route which they're rendered to.
+func (fs *Fileserver) urlPaths(origPath string) []string {
+	p := fs.urlPath(origPath)
+	if route, ok := renderedRoute(p); ok {
+		return []string{p, route}
+	}
+	return []string{p}
+}
+
+// sync the served content of origPath with master, by mirroring it or by
+// invalidating its overlay entry
+func (fs *Fileserver) sync(origPath string) error {
+	if fs.overlay != nil {
+		fs.overlay.invalidate(fs.relPath(origPath))
+		return nil
+	}
+	return fs.mirrorFile(origPath)
+}
+
+func (fs *Fileserver) mirrorFile(origPath string) error {
+	fileB, err := os.ReadFile(origPath)
 	if err != nil {
-		return fmt.Errorf("failed to inject websocket script: %v", err)
+		return fmt.Errorf("failed to read file on path: '%v', err: %w", origPath, err)
 	}
-	if injected {
-		ancli.PrintfNotice("injected delta-streamer script loading tag in: '%v'", origPath)
+	fileB = fs.expandIncludes(origPath, fileB)
+	strategy, injectedBytes := injectWebsocketScript(fs.injectRules, fs.relPath(origPath), fileB)
+	if strategy != injectNone {
+		ancli.PrintfNotice("injected delta-streamer script loading tag in: '%v', using strategy: '%v'", origPath, strategy)
 	}
-	mirroredPath := path.Join(fs.mirrorPath, relativePath)
+	mirroredPath := fs.mirroredPath(origPath)
 	relativePathDir := path.Dir(mirroredPath)
 	err = os.MkdirAll(relativePathDir, 0o755)
 	if err != nil {
@@ -83,10 +164,37 @@ func (fs *Fileserver) mirrorFile(origPath string) error {
 	return nil
 }
 
+// unmirror removes the mirrored version, or overlay entry, of origPath, recursively if
+// it's a directory, and stops watching it along with any watched subdirectories
+func (fs *Fileserver) unmirror(origPath string) error {
+	for _, watched := range fs.watcher.WatchList() {
+		if watched == origPath || strings.HasPrefix(watched, origPath+string(filepath.Separator)) {
+			// Removed directories are dropped automatically by the watcher, so
+			// the error here is expected and only renamed directories needs explicit removal
+			_ = fs.watcher.Remove(watched)
+		}
+	}
+	if fs.overlay != nil {
+		fs.overlay.invalidate(fs.relPath(origPath))
+		return nil
+	}
+	err := os.RemoveAll(fs.mirroredPath(origPath))
+	if err != nil {
+		return fmt.Errorf("failed to remove mirrored path: %w", err)
+	}
+	return nil
+}
+
 func (fs *Fileserver) mirrorMaker(p string, info os.DirEntry, err error) error {
 	if err != nil {
 		return err
 	}
+	if fs.isIgnored(p, info.IsDir()) {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
 	if info.IsDir() {
 		err = fs.watcher.Add(p)
 		if err != nil {
@@ -95,131 +203,349 @@ func (fs *Fileserver) mirrorMaker(p string, info os.DirEntry, err error) error {
 		return nil
 	}
 
-	return fs.mirrorFile(p)
+	return fs.sync(p)
 }
 
-func (fs *Fileserver) writeDeltaStreamerScript() error {
-	tlsS := ""
-	if fs.expectTLS {
-		tlsS = "s"
-	}
-	err := os.WriteFile(
-		path.Join(fs.mirrorPath, "delta-streamer.js"),
-		[]byte(fmt.Sprintf(deltaStreamerSourceCode, tlsS, fs.wsPort, fs.wsPath, fs.forceReload)),
-		0o755)
-	if err != nil {
-		return fmt.Errorf("failed to write delta-streamer.js: %w", err)
-	}
-	return nil
+func (fs *Fileserver) deltaStreamerScript() []byte {
+	return []byte(fmt.Sprintf(deltaStreamerSourceCode,
+		strconv.Quote(fs.publicURL),
+		strconv.Quote(fs.wsPath),
+		fs.forwardConsole,
+		strconv.Quote(fs.spaFallback),
+		fs.forceReload))
+}
+
+// ClientScriptHandler serves the delta-streamer script, on ClientScriptPath
+func (fs *Fileserver) ClientScriptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(fs.deltaStreamerScript())
 }
 
 func (fs *Fileserver) Setup(pathToMaster string) (string, error) {
 	ancli.PrintfNotice("mirroring root: '%v'", pathToMaster)
 	fs.masterPath = pathToMaster
-	watcher, err := fsnotify.NewWatcher()
-	fs.watcher = watcher
+	removeStaleMirrors(fs.tmpDir)
+	err := fs.setupBuildCommands()
+	if err != nil {
+		return "", fmt.Errorf("failed to setup build commands: %w", err)
+	}
+	err = fs.setupMarkdownLayout()
+	if err != nil {
+		return "", fmt.Errorf("failed to setup markdown layout: %w", err)
+	}
+	err = fs.setupWatcher()
+	if err != nil {
+		return "", fmt.Errorf("failed to setup watcher: %w", err)
+	}
+	err = fs.setupIgnorer()
 	if err != nil {
-		return "", fmt.Errorf("failed to create fsnotify watcher: %w", err)
+		return "", fmt.Errorf("failed to setup ignore patterns: %w", err)
+	}
+	switch fs.mode {
+	case ModeMirror:
+		err = fs.setupMirrorDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to setup mirror dir: %w", err)
+		}
+	case ModeOverlay, ModeMiddleware:
+		fs.overlay = newOverlayFS(os.DirFS(pathToMaster), fs.mode == ModeOverlay, fs.injectRules, fs.ignore.match)
+		fs.overlay.expand = func(name string, b []byte) ([]byte, time.Time) {
+			origPath := filepath.Join(fs.masterPath, filepath.FromSlash(name))
+			b = fs.expandIncludes(origPath, b)
+			return b, latestModTime(fs.deps.on(origPath))
+		}
+	default:
+		return "", fmt.Errorf("unknown mode: '%v'", fs.mode)
 	}
 	err = wsInjectMaster(pathToMaster, fs.mirrorMaker)
 	if err != nil {
 		return "", fmt.Errorf("failed to create websocket injected mirror: %v", err)
 	}
-	err = fs.writeDeltaStreamerScript()
-	if err != nil {
-		return "", fmt.Errorf("failed to write delta streamer file: %w", err)
+	if fs.mirrorDir != "" {
+		err = fs.pruneMirror()
+		if err != nil {
+			return "", fmt.Errorf("failed to prune reused mirror: %w", err)
+		}
 	}
 	return fs.mirrorPath, nil
 }
 
+func (fs *Fileserver) setupWatcher() error {
+	if fs.poll {
+		if fs.pollInterval <= 0 {
+			// Falling back to fsnotify would silently never reload where polling is needed
+			return fmt.Errorf("invalid poll interval: '%v', expected a positive duration", fs.pollInterval)
+		}
+		ancli.PrintfNotice("polling for file changes every: '%v'", fs.pollInterval)
+		fs.watcher = newPollWatcher(fs.pollInterval, fs.pollHash)
+		return nil
+	}
+	w, err := newFsnotifyWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create fsnotify watcher: %w", err)
+	}
+	fs.watcher = w
+	return nil
+}
+
 // Start listening to file events, update mirror and stream notifications
-// on which files to update
+// on which files to update. Events are gathered per path until no new event
+// has arrived within the debounce window, then handled as one batch.
 func (fs *Fileserver) Start(ctx context.Context) error {
+	// Changes are dispatched even before any browser has connected
+	fs.ensureWsDispatcher()
+	pending := make(map[string]fsnotify.Op)
+	settle := time.NewTimer(fs.debounce)
+	settle.Stop()
+	defer settle.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case fsEv, ok := <-fs.watcher.Events:
+		case fsEv, ok := <-fs.watcher.Events():
 			if !ok {
-				return errors.New("fsnotify watcher event channel closed")
+				return errors.New("watcher event channel closed")
+			}
+			if fs.debounce <= 0 {
+				fs.notifyPageUpdate(ctx, fs.handleFileEvent(fsEv)...)
+				continue
 			}
-			fs.handleFileEvent(fsEv)
-		case fsErr, ok := <-fs.watcher.Errors:
+			pending[fsEv.Name] |= fsEv.Op
+			settle.Reset(fs.debounce)
+		case <-settle.C:
+			fs.handleBatch(ctx, pending)
+			pending = make(map[string]fsnotify.Op)
+		case fsErr, ok := <-fs.watcher.Errors():
 			if !ok {
-				return errors.New("fsnotify watcher error channel closed")
+				return errors.New("watcher error channel closed")
 			}
 			return fsErr
 		}
 	}
 }
 
-func (fs *Fileserver) notifyPageUpdate(fileName string) {
-	// Make filename relative idempotently
-	fs.pageReloadChan <- strings.ReplaceAll(fileName, fs.masterPath, "")
+// handleBatch handles the merged events of every path, then notifies all
+// changes at once so that each page reloads once per burst
+func (fs *Fileserver) handleBatch(ctx context.Context, pending map[string]fsnotify.Op) {
+	var changed []change
+	for name, op := range pending {
+		changed = append(changed, fs.handleFileEvent(fsnotify.Event{Name: name, Op: op})...)
+	}
+	fs.notifyPageUpdate(ctx, changed...)
 }
 
-func (fs *Fileserver) handleFileEvent(fsEv fsnotify.Event) {
-	if fsEv.Has(fsnotify.Write) {
-		ancli.PrintfNotice("noticed file write in orig file: '%v'", fsEv.Name)
-		fs.mirrorFile(fsEv.Name)
-		fs.notifyPageUpdate(fsEv.Name)
+// notifyPageUpdate sends the changes as one batch, once the build commands matching
+// them have succeeded. The paths of the changes are the original paths, they're sent
+// as the root-relative url paths they're served on, such as '/blog/index.html', along
+// with the hash of their current content
+func (fs *Fileserver) notifyPageUpdate(ctx context.Context, changes ...change) {
+	if len(changes) == 0 {
+		return
+	}
+	changes = fs.withDependents(changes)
+	if !fs.build(ctx, changes) {
+		return
 	}
+	batch := make([]change, 0, len(changes))
+	for _, c := range changes {
+		if c.Kind != changeRemove {
+			if hash, err := hashFile(c.Path); err == nil {
+				c.Hash = hex.EncodeToString(hash[:])
+			}
+		}
+		for _, p := range fs.urlPaths(c.Path) {
+			batch = append(batch, change{Path: p, Kind: c.Kind, Hash: c.Hash})
+		}
+	}
+	slices.SortStableFunc(batch, func(a, b change) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	batch = slices.CompactFunc(batch, func(a, b change) bool {
+		return a.Path == b.Path
+	})
+	fs.pageReloadChan <- message{Type: msgChange, Changes: batch}
 }
 
-func wsInjectMaster(root string, do func(path string, d fs.DirEntry, err error) error) error {
-	err := filepath.WalkDir(root, do)
-	if err != nil {
-		log.Fatalf("Error walking the path %q: %v\n", root, err)
+// withDependents adds the pages built from the changed files to the changes, such as
+// the pages using a changed layout. The pages are synced, so that they're rebuilt.
+func (fs *Fileserver) withDependents(changes []change) []change {
+	for _, c := range changes {
+		for _, page := range fs.deps.of(c.Path) {
+			err := fs.sync(page)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				ancli.Errf("failed to sync dependent page: '%v', err: %v", page, err)
+			}
+			changes = append(changes, change{Path: page, Kind: changeWrite})
+		}
 	}
-	return nil
+	return changes
 }
 
-func injectScript(html []byte, scriptTag string) ([]byte, error) {
-	htmlStr := string(html)
-
-	// Find the location of the closing `</header>` tag
-	idx := strings.Index(htmlStr, "</head>")
-	if idx == -1 {
-		return html, ErrNoHeaderTagFound
+// changesOf the original paths, all of the same kind
+func changesOf(kind changeKind, origPaths ...string) []change {
+	changes := make([]change, 0, len(origPaths))
+	for _, p := range origPaths {
+		changes = append(changes, change{Path: p, Kind: kind})
 	}
+	return changes
+}
 
-	var buf bytes.Buffer
+// handleFileEvent updates the mirror according to the event and returns the changes
+// it caused. The event may contain several merged operations, so the
+// current state of the path decides how it's handled.
+func (fs *Fileserver) handleFileEvent(fsEv fsnotify.Event) []change {
+	info, statErr := os.Stat(fsEv.Name)
+	if fs.isIgnored(fsEv.Name, statErr == nil && info.IsDir()) {
+		return nil
+	}
+	switch {
+	case fsEv.Has(fsnotify.Remove), fsEv.Has(fsnotify.Rename):
+		if statErr == nil {
+			// The path has been recreated since it was removed, such as on atomic saves
+			ancli.PrintfNotice("noticed replacement of orig path: '%v'", fsEv.Name)
+			return changesOf(changeWrite, fs.handleCreate(fsEv.Name)...)
+		}
+		// Renames are reported on the old name, the new name arrives as a separate create event
+		ancli.PrintfNotice("noticed removal of orig path: '%v'", fsEv.Name)
+		err := fs.unmirror(fsEv.Name)
+		if err != nil {
+			ancli.Errf("failed to unmirror: '%v', err: %v", fsEv.Name, err)
+		}
+		return changesOf(changeRemove, fsEv.Name)
+	case fsEv.Has(fsnotify.Create):
+		ancli.PrintfNotice("noticed creation of orig path: '%v'", fsEv.Name)
+		return changesOf(changeCreate, fs.handleCreate(fsEv.Name)...)
+	case fsEv.Has(fsnotify.Write), fsEv.Has(fsnotify.Chmod):
+		ancli.PrintfNotice("noticed file %v in orig file: '%v'", strings.ToLower(fsEv.Op.String()), fsEv.Name)
+		return changesOf(changeWrite, fs.handleUpdate(fsEv.Name)...)
+	}
+	return nil
+}
 
-	// Write the HTML up to the closing `</head>` tag
-	_, err := buf.WriteString(htmlStr[:idx])
+// handleCreate mirrors a newly created file, or walks, mirrors and watches a newly
+// created directory. Every mirrored file is returned, since files created within a new
+// directory before it has been watched won't cause any events of their own
+func (fs *Fileserver) handleCreate(origPath string) []string {
+	info, err := os.Stat(origPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write pre: %w", err)
+		ancli.Errf("failed to stat created path: '%v', err: %v", origPath, err)
+		return nil
 	}
-
-	_, err = buf.WriteString(scriptTag)
+	if !info.IsDir() {
+		return fs.handleUpdate(origPath)
+	}
+	var created []string
+	err = wsInjectMaster(origPath, func(p string, d os.DirEntry, err error) error {
+		err = fs.mirrorMaker(p, d, err)
+		if err == nil && !fs.isIgnored(p, d.IsDir()) {
+			created = append(created, p)
+		}
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to write script tag: %w", err)
+		ancli.Errf("failed to mirror created directory: '%v', err: %v", origPath, err)
 	}
+	return created
+}
 
-	_, err = buf.WriteString(htmlStr[idx:])
+func (fs *Fileserver) handleUpdate(origPath string) []string {
+	info, err := os.Stat(origPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// The file was removed before it could be synced, the remove event will notify
+		return nil
+	}
+	if err == nil && info.IsDir() {
+		// Directories are only affected by creations and removals of their content
+		return nil
+	}
+	err = fs.sync(origPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to write post: %w", err)
+		ancli.Errf("failed to mirror file: '%v', err: %v", origPath, err)
+		return nil
 	}
-
-	return buf.Bytes(), nil
+	return []string{origPath}
 }
 
-func injectWebsocketScript(b []byte) (bool, []byte, error) {
-	contentType := http.DetectContentType(b)
-	injected := false
-	// Only act on html files
-	if !strings.Contains(contentType, "text/html") {
-		return injected, b, nil
-	}
-	b, err := injectScript(b, deltaStreamer)
-	injected = true
+func wsInjectMaster(root string, do func(path string, d fs.DirEntry, err error) error) error {
+	err := filepath.WalkDir(root, do)
 	if err != nil {
-		if !errors.Is(err, ErrNoHeaderTagFound) {
-			return injected, nil, fmt.Errorf("failed to inject script tag: %w", err)
-		} else {
-			injected = false
+		return fmt.Errorf("error walking the path %q: %w", root, err)
+	}
+	return nil
+}
+
+// injectStrategy describes where the script has been injected
+type injectStrategy string
+
+const (
+	// injectNone means that nothing has been injected
+	injectNone injectStrategy = ""
+	// injectHead injects before </head>
+	injectHead injectStrategy = "head"
+	// injectHeadStart injects after <head>, if it's never closed
+	injectHeadStart injectStrategy = "head-start"
+	// injectBody injects before </body>, for documents without a head
+	injectBody injectStrategy = "body"
+	// injectTop injects at the top of the document, after the doctype, for fragments
+	injectTop injectStrategy = "top"
+)
+
+// injectionPoint tokenizes the html document to find where the script should be
+// injected. Tags within comments, scripts and other raw text are disregarded.
+func injectionPoint(b []byte) (int, injectStrategy) {
+	z := html.NewTokenizer(bytes.NewReader(b))
+	offset := 0
+	afterDoctype, afterHeadStart, beforeBodyEnd := 0, -1, -1
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
 		}
+		raw := len(z.Raw())
+		name, _ := z.TagName()
+		switch {
+		case tt == html.DoctypeToken:
+			afterDoctype = offset + raw
+		case tt == html.StartTagToken && string(name) == "head" && afterHeadStart == -1:
+			afterHeadStart = offset + raw
+		case tt == html.EndTagToken && string(name) == "head":
+			return offset, injectHead
+		case tt == html.EndTagToken && string(name) == "body":
+			beforeBodyEnd = offset
+		}
+		offset += raw
+	}
+	switch {
+	case afterHeadStart != -1:
+		return afterHeadStart, injectHeadStart
+	case beforeBodyEnd != -1:
+		return beforeBodyEnd, injectBody
+	default:
+		return afterDoctype, injectTop
 	}
+}
 
-	return injected, b, nil
+// injectScript into the html document, at the point found by injectionPoint
+func injectScript(html []byte, scriptTag string) ([]byte, injectStrategy) {
+	idx, strategy := injectionPoint(html)
+	var buf bytes.Buffer
+	buf.Grow(len(html) + len(scriptTag))
+	buf.Write(html[:idx])
+	buf.WriteString(scriptTag)
+	buf.Write(html[idx:])
+	return buf.Bytes(), strategy
+}
+
+// injectWebsocketScript into b if the rules match it and it hasn't opted out,
+// returning how it was injected
+func injectWebsocketScript(rules *injectRules, relPath string, b []byte) (injectStrategy, []byte) {
+	if !rules.match(relPath, http.DetectContentType(b)) || optedOut(b) {
+		return injectNone, b
+	}
+	b, strategy := injectScript(b, deltaStreamer)
+	return strategy, b
 }
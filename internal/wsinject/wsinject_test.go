@@ -2,7 +2,12 @@ package wsinject
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
@@ -64,6 +69,85 @@ const mockHtml = `<!DOCTYPE html>
   </body>
 </html>`
 
+func Test_injectScript(t *testing.T) {
+	const tag = "<script>wd-41</script>"
+	tests := []struct {
+		name         string
+		given        string
+		want         string
+		wantStrategy injectStrategy
+	}{
+		{
+			name:         "it should inject before closing head tag",
+			given:        "<html><head><title>t</title></head><body></body></html>",
+			want:         "<html><head><title>t</title>" + tag + "</head><body></body></html>",
+			wantStrategy: injectHead,
+		},
+		{
+			name:         "it should match head tags case insensitively",
+			given:        "<HTML><HEAD></HEAD><BODY></BODY></HTML>",
+			want:         "<HTML><HEAD>" + tag + "</HEAD><BODY></BODY></HTML>",
+			wantStrategy: injectHead,
+		},
+		{
+			name:         "it should disregard head tags in comments",
+			given:        "<html><!-- </head> --><head></head></html>",
+			want:         "<html><!-- </head> --><head>" + tag + "</head></html>",
+			wantStrategy: injectHead,
+		},
+		{
+			name:         "it should disregard head tags in inline scripts",
+			given:        "<html><head><script>const s = '</head>';</script></head></html>",
+			want:         "<html><head><script>const s = '</head>';</script>" + tag + "</head></html>",
+			wantStrategy: injectHead,
+		},
+		{
+			name:         "it should inject after head start tag if head is never closed",
+			given:        "<!DOCTYPE html><head><title>t</title><body>hi</body>",
+			want:         "<!DOCTYPE html><head>" + tag + "<title>t</title><body>hi</body>",
+			wantStrategy: injectHeadStart,
+		},
+		{
+			name:         "it should inject before closing body tag without head",
+			given:        "<!DOCTYPE html><title>t</title><p>hi</p></body>",
+			want:         "<!DOCTYPE html><title>t</title><p>hi</p>" + tag + "</body>",
+			wantStrategy: injectBody,
+		},
+		{
+			name:         "it should inject at top of fragments",
+			given:        "<div>fragment</div>",
+			want:         tag + "<div>fragment</div>",
+			wantStrategy: injectTop,
+		},
+		{
+			name:         "it should inject after doctype at top of documents",
+			given:        "<!DOCTYPE html>\n<p>minimal</p>",
+			want:         "<!DOCTYPE html>" + tag + "\n<p>minimal</p>",
+			wantStrategy: injectTop,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, gotStrategy := injectScript([]byte(tc.given), tag)
+			testboil.FailTestIfDiff(t, string(got), tc.want)
+			testboil.FailTestIfDiff(t, gotStrategy, tc.wantStrategy)
+		})
+	}
+}
+
+// setupFileServer sets up fs to serve master, with its temporary mirror within the
+// temporary directory of the test, and closes it once the test is done
+func setupFileServer(t *testing.T, fs *Fileserver, master string) string {
+	t.Helper()
+	fs.tmpDir = t.TempDir()
+	mirrorPath, err := fs.Setup(master)
+	if err != nil {
+		t.Fatalf("failed to setup: %v", err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return mirrorPath
+}
+
 func Test_Setup(t *testing.T) {
 	tmpDir := t.TempDir()
 	ancli.Newline = true
@@ -76,18 +160,15 @@ func Test_Setup(t *testing.T) {
 	}
 	nestedFile := path.Join(nestedDir, "nested.html")
 	os.WriteFile(nestedFile, []byte(mockHtml), 0o777)
-	fs := NewFileServer(8080, "/delta-streamer-ws.js", false, false)
-	_, err = fs.Setup(tmpDir)
-	if err != nil {
-		t.Fatalf("failed to setup: %v", err)
-	}
+	fs := NewFileServer("/delta-streamer-ws.js", false)
+	setupFileServer(t, fs, tmpDir)
 	checkIfInjected := func(t *testing.T, filePath string) {
 		b, err := os.ReadFile(filePath)
 		if err != nil {
 			t.Fatalf("failed to read mirrored file: %v", err)
 		}
-		if !strings.Contains(string(b), "delta-streamer.js") {
-			t.Fatalf("expected mirrored file: '%v' to have been injected with content-streamer.js", filePath)
+		if !strings.Contains(string(b), `src="`+ClientScriptPath+`"`) {
+			t.Fatalf("expected mirrored file: '%v' to have been injected with absolute client script path", filePath)
 		}
 	}
 	t.Run("it should inject delta-streamer.js source tag", func(t *testing.T) {
@@ -100,21 +181,33 @@ func Test_Setup(t *testing.T) {
 		checkIfInjected(t, mirrorFilePath)
 	})
 
-	checkIfDeltaStreamerExists := func(t *testing.T, filePath string) {
-		t.Helper()
-		b, err := os.ReadFile(filePath)
-		if err != nil {
-			t.Fatalf("failed to find delta-streamer.js: %v", err)
-		}
-		// Whatever happens in the delta streamre source code, it should mention wd-41
-		if !strings.Contains(string(b), "wd-41") {
-			t.Fatal("expected delta-streamer.js file to conain string 'wd-41'")
+	t.Run("it should serve the delta streamer script on the client script handler", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		fs.ClientScriptHandler(rec, httptest.NewRequest(http.MethodGet, ClientScriptPath, nil))
+		// Whatever happens in the delta streamer source code, it should mention wd-41
+		testboil.AssertStringContains(t, rec.Body.String(), "wd-41")
+		testboil.AssertStringContains(t, rec.Header().Get("Content-Type"), "javascript")
+	})
+
+	t.Run("it should not write the delta streamer file into the mirror", func(t *testing.T) {
+		_, err := os.Stat(path.Join(fs.mirrorPath, "delta-streamer.js"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected no delta-streamer.js in mirror, got err: %v", err)
 		}
-	}
-	t.Run("it should write the delta streamer file to root of mirror", func(t *testing.T) {
-		mirrorFilePath := path.Join(fs.mirrorPath, "delta-streamer.js")
-		checkIfDeltaStreamerExists(t, mirrorFilePath)
 	})
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		t.Run(fmt.Sprintf("it should fail to poll with interval: %v", interval), func(t *testing.T) {
+			fs := NewFileServer("/delta-streamer-ws.js", false, WithPollWatcher(interval, false))
+			fs.tmpDir = t.TempDir()
+			t.Cleanup(func() { fs.Close() })
+			_, err := fs.Setup(t.TempDir())
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			testboil.AssertStringContains(t, err.Error(), "invalid poll interval")
+		})
+	}
 }
 
 type testFileSystem struct {
@@ -144,7 +237,7 @@ func Test_Start(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to create temp dir: %v", err)
 		}
-		return NewFileServer(8080, "/delta-streamer-ws.js", false, false), testFileSystem{
+		return NewFileServer("/delta-streamer-ws.js", false), testFileSystem{
 			root:      tmpDir,
 			nestedDir: nestedDir,
 		}
@@ -152,22 +245,19 @@ func Test_Start(t *testing.T) {
 
 	t.Run("it should break on context cancel", func(t *testing.T) {
 		fs, _ := setup(t)
-		_, err := fs.Setup(t.TempDir())
-		if err != nil {
-			t.Fatalf("failed ot setup test fileserver: %v", err)
-		}
+		setupFileServer(t, fs, t.TempDir())
 		testboil.ReturnsOnContextCancel(t, func(ctx context.Context) {
 			fs.Start(ctx)
 		}, time.Second)
 	})
 
 	t.Run("file changes", func(t *testing.T) {
-		setupReadyFs := func(t *testing.T) (testFileSystem, chan error, chan string, context.Context) {
+		setupReadyFs := func(t *testing.T) (*Fileserver, testFileSystem, chan error, chan message, context.Context) {
 			t.Helper()
 			fs, testFileSystem := setup(t)
 			testFileSystem.addRootFile(t, "")
-			fs.Setup(testFileSystem.root)
-			refreshChan := make(chan string)
+			setupFileServer(t, fs, testFileSystem.root)
+			refreshChan := make(chan message)
 			fs.registerWs("mock", refreshChan)
 			timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second)
 			t.Cleanup(cancel)
@@ -184,11 +274,27 @@ func Test_Start(t *testing.T) {
 			<-awaitFsStart
 			// Give the Start a moment to actually start, not just the routine
 			time.Sleep(time.Millisecond)
-			return testFileSystem, earlyFail, refreshChan, timeoutCtx
+			return fs, testFileSystem, earlyFail, refreshChan, timeoutCtx
+		}
+
+		awaitRefresh := func(t *testing.T, earlyFail chan error, refreshChan chan message, timeoutCtx context.Context, want string) {
+			t.Helper()
+			for {
+				select {
+				case err := <-earlyFail:
+					t.Fatalf("start failed: %v", err)
+				case got := <-refreshChan:
+					if slices.Contains(got.paths(), want) {
+						return
+					}
+				case <-timeoutCtx.Done():
+					t.Fatalf("failed to receive refresh of: '%v' within time", want)
+				}
+			}
 		}
 
 		t.Run("it should send a reload event on file changes", func(t *testing.T) {
-			testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
+			_, testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
 			testFile := testFileSystem.rootDirFilePaths[0]
 			os.WriteFile(testFile, []byte("changes!"), 0o755)
 
@@ -196,23 +302,161 @@ func Test_Start(t *testing.T) {
 			case err := <-earlyFail:
 				t.Fatalf("start failed: %v", err)
 			case got := <-refreshChan:
-				testboil.FailTestIfDiff(t, got, "/"+filepath.Base(testFile))
+				testboil.FailTestIfDiff(t, strings.Join(got.paths(), "\n"), "/"+filepath.Base(testFile))
+			case <-timeoutCtx.Done():
+				t.Fatal("failed to receive refresh within time")
+			}
+		})
+
+		t.Run("it should send the kind and content hash of changes", func(t *testing.T) {
+			_, testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
+			testFile := testFileSystem.rootDirFilePaths[0]
+			os.WriteFile(testFile, []byte("changes!"), 0o755)
+
+			select {
+			case err := <-earlyFail:
+				t.Fatalf("start failed: %v", err)
+			case got := <-refreshChan:
+				sum := sha256.Sum256([]byte("changes!"))
+				testboil.FailTestIfDiff(t, got.Changes[0], change{
+					Path: "/" + filepath.Base(testFile),
+					Kind: changeWrite,
+					Hash: hex.EncodeToString(sum[:]),
+				})
 			case <-timeoutCtx.Done():
 				t.Fatal("failed to receive refresh within time")
 			}
 		})
 
 		t.Run("it should send a reload event on file additions", func(t *testing.T) {
-			testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
+			_, testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
 			testFile := testFileSystem.addRootFile(t, "")
 			select {
 			case err := <-earlyFail:
 				t.Fatalf("start failed: %v", err)
 			case got := <-refreshChan:
-				testboil.FailTestIfDiff(t, got, "/"+filepath.Base(testFile))
+				testboil.FailTestIfDiff(t, strings.Join(got.paths(), "\n"), "/"+filepath.Base(testFile))
 			case <-timeoutCtx.Done():
 				t.Fatal("failed to receive refresh within time")
 			}
 		})
+
+		t.Run("it should unmirror and send a reload event on file removals", func(t *testing.T) {
+			fs, testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
+			testFile := testFileSystem.rootDirFilePaths[0]
+			err := os.Remove(testFile)
+			if err != nil {
+				t.Fatalf("failed to remove test file: %v", err)
+			}
+			awaitRefresh(t, earlyFail, refreshChan, timeoutCtx, "/"+filepath.Base(testFile))
+			_, err = os.Stat(path.Join(fs.mirrorPath, filepath.Base(testFile)))
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected mirrored file to be removed, got err: %v", err)
+			}
+		})
+
+		t.Run("it should unmirror the old name and mirror the new name on renames", func(t *testing.T) {
+			fs, testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
+			testFile := testFileSystem.rootDirFilePaths[0]
+			renamed := path.Join(testFileSystem.root, "renamed.html")
+			err := os.Rename(testFile, renamed)
+			if err != nil {
+				t.Fatalf("failed to rename test file: %v", err)
+			}
+			awaitRefresh(t, earlyFail, refreshChan, timeoutCtx, "/renamed.html")
+			_, err = os.Stat(path.Join(fs.mirrorPath, "renamed.html"))
+			if err != nil {
+				t.Fatalf("expected renamed file to be mirrored, got err: %v", err)
+			}
+			_, err = os.Stat(path.Join(fs.mirrorPath, filepath.Base(testFile)))
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected old mirrored file to be removed, got err: %v", err)
+			}
+		})
+
+		t.Run("it should mirror and watch newly created directories", func(t *testing.T) {
+			fs, testFileSystem, earlyFail, refreshChan, timeoutCtx := setupReadyFs(t)
+			newDir := path.Join(testFileSystem.root, "new", "deeper")
+			err := os.MkdirAll(newDir, 0o777)
+			if err != nil {
+				t.Fatalf("failed to create new dir: %v", err)
+			}
+			awaitRefresh(t, earlyFail, refreshChan, timeoutCtx, "/new/deeper")
+			err = os.WriteFile(path.Join(newDir, "page.html"), []byte(mockHtml), 0o777)
+			if err != nil {
+				t.Fatalf("failed to write file in new dir: %v", err)
+			}
+			awaitRefresh(t, earlyFail, refreshChan, timeoutCtx, "/new/deeper/page.html")
+			b, err := os.ReadFile(path.Join(fs.mirrorPath, "new", "deeper", "page.html"))
+			if err != nil {
+				t.Fatalf("expected file in new dir to be mirrored, got err: %v", err)
+			}
+			testboil.AssertStringContains(t, string(b), ClientScriptPath)
+		})
+
+		t.Run("it should batch events within the debounce window into one reload event", func(t *testing.T) {
+			fs, testFileSystem := setup(t)
+			WithDebounce(50 * time.Millisecond)(fs)
+			setupFileServer(t, fs, testFileSystem.root)
+			refreshChan := make(chan message)
+			fs.registerWs("mock", refreshChan)
+			timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			t.Cleanup(cancel)
+			go fs.Start(timeoutCtx)
+			time.Sleep(time.Millisecond)
+
+			var want []string
+			for range 3 {
+				want = append(want, "/"+filepath.Base(testFileSystem.addRootFile(t, ".html")))
+			}
+			select {
+			case got := <-refreshChan:
+				testboil.FailTestIfDiff(t, strings.Join(got.paths(), "\n"), strings.Join(want, "\n"))
+			case <-timeoutCtx.Done():
+				t.Fatal("failed to receive refresh within time")
+			}
+			select {
+			case got := <-refreshChan:
+				t.Fatalf("expected only one batched reload event, got another: '%v'", got)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+
+		t.Run("it should send a reload event on file changes using the poll watcher", func(t *testing.T) {
+			fs, testFileSystem := setup(t)
+			WithPollWatcher(5*time.Millisecond, false)(fs)
+			testFile := testFileSystem.addRootFile(t, ".html")
+			setupFileServer(t, fs, testFileSystem.root)
+			refreshChan := make(chan message)
+			fs.registerWs("mock", refreshChan)
+			timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			t.Cleanup(cancel)
+			earlyFail := make(chan error, 1)
+			go func() {
+				err := fs.Start(timeoutCtx)
+				if err != nil {
+					earlyFail <- err
+				}
+			}()
+			os.WriteFile(testFile, []byte("changes!"), 0o755)
+			awaitRefresh(t, earlyFail, refreshChan, timeoutCtx, "/"+filepath.Base(testFile))
+		})
 	})
 }
+
+func Test_urlPath(t *testing.T) {
+	fs := &Fileserver{masterPath: filepath.FromSlash("/srv/site")}
+	for _, tc := range []struct {
+		origPath string
+		want     string
+	}{
+		{origPath: "/srv/site/index.html", want: "/index.html"},
+		{origPath: "/srv/site/blog/index.html", want: "/blog/index.html"},
+		{origPath: "/srv/site/docs/srv/site/page.html", want: "/docs/srv/site/page.html"},
+		{origPath: "/srv/site", want: "/"},
+	} {
+		t.Run(tc.origPath, func(t *testing.T) {
+			testboil.FailTestIfDiff(t, fs.urlPath(filepath.FromSlash(tc.origPath)), tc.want)
+		})
+	}
+}
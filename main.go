@@ -13,6 +13,7 @@ import (
 
 var commands = map[string]cmd.Command{
 	"s|serve":   serve.Command(),
+	"p|proxy":   serve.ProxyCommand(),
 	"v|version": version.Command(),
 }
 